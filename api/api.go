@@ -16,6 +16,9 @@ import (
 	"github.com/jcelliott/lumber"
 	"github.com/nanobox-io/golang-nanoauth"
 	"github.com/spf13/viper"
+
+	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/spool"
 )
 
 // structs
@@ -29,8 +32,15 @@ type (
 )
 
 var (
-	BadJson      = errors.New("Bad JSON syntax received in body")
-	BodyReadFail = errors.New("Body Read Failed")
+	BadJson       = errors.New("Bad JSON syntax received in body")
+	BodyReadFail  = errors.New("Body Read Failed")
+	AmbiguousStat = errors.New("Stat is a field of more than one measurement, pick one with 'measurement'")
+)
+
+var (
+	// Plex and Spool, when set, have their stats reported at /publishers
+	Plex  *plexer.Plexer
+	Spool *spool.Spool
 )
 
 // start sets the state of the package if the config has all the necessary data for the api
@@ -68,6 +78,13 @@ func registerRoutes() (*pat.Router, error) {
 
 	router.Get("/keys", keysRequest)
 	router.Get("/tags", tagsRequest)
+	router.Get("/failures", doCors(failuresRequest))
+	router.Get("/publishers", doCors(publishersRequest))
+	router.Get("/stream", doCors(streamStats))
+
+	router.Post("/config/{host}/{collector}", doCors(setConfig))
+	router.Put("/config/{host}/{collector}", doCors(setConfig))
+	router.Get("/config", doCors(getConfig))
 
 	router.Get("/latest/{stat}", doCors(latestStat))
 	router.Get("/hourly/{stat}", doCors(hourlyStat))
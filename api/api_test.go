@@ -1,19 +1,24 @@
 package api_test
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/spf13/viper"
 
 	"github.com/nanopack/pulse/api"
 	"github.com/nanopack/pulse/kapacitor"
+	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/spool"
 )
 
 var apiAddr = "0.0.0.0:9898"
@@ -119,6 +124,148 @@ func TestGetDaily(t *testing.T) {
 	}
 }
 
+func TestConfig(t *testing.T) {
+	resp, err := rest("PUT", "/config/test-host/cpu", `{"interval":5}`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(resp) != "{\"enabled\":true,\"interval\":5,\"applied\":false}\n" {
+		t.Errorf("%s doesn't match expected out", resp)
+	}
+
+	resp, err = rest("PUT", "/config/test-host/cpu", `{"interval":-1}`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(resp) != "{\"error\":\"Interval must not be negative\"}\n" {
+		t.Errorf("%s doesn't match expected out", resp)
+	}
+
+	resp, err = rest("GET", "/config", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(resp) != "{\"test-host\":{\"cpu\":{\"enabled\":true,\"interval\":5,\"applied\":false}}}\n" {
+		t.Errorf("%s doesn't match expected out", resp)
+	}
+}
+
+func TestPublishers(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	api.Plex = plexer.NewPlexer()
+	api.Plex.AddBatcher("influx", func(plexer.MessageSet) error { return nil })
+	sp, err := spool.New(dir, func(plexer.MessageSet) error { return fmt.Errorf("down") }, spool.Options{})
+	if err != nil {
+		t.Fatalf("Failed to open spool - %s", err)
+	}
+	api.Spool = sp
+	defer func() {
+		api.Plex.Close()
+		sp.Close()
+		api.Plex, api.Spool = nil, nil
+	}()
+	sp.Publish(plexer.MessageSet{Messages: []plexer.Message{{ID: "cpu_used", Data: "0.34"}}})
+
+	resp, err := rest("GET", "/publishers", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var stats struct {
+		Publishers []plexer.PublisherInfo `json:"publishers"`
+		Spool      struct {
+			Depth int   `json:"depth"`
+			Size  int64 `json:"size"`
+		} `json:"spool"`
+	}
+	if err := json.Unmarshal(resp, &stats); err != nil {
+		t.Fatalf("Bad response '%s' - %s", resp, err)
+	}
+	if len(stats.Publishers) != 1 || stats.Publishers[0].Name != "influx" || stats.Spool.Depth != 1 || stats.Spool.Size == 0 {
+		t.Errorf("%s doesn't match expected out", resp)
+	}
+}
+
+// publish stats until the stream has had time to subscribe
+func publishStats(done chan struct{}) {
+	for {
+		api.Publish(plexer.MessageSet{
+			Tags: []string{"host:web1"},
+			Messages: []plexer.Message{
+				{ID: "ram_used", Data: "0.5", Value: 0.5},
+				{ID: "cpu_used", Data: "0.25", Value: 0.25},
+			},
+		})
+		api.Publish(plexer.MessageSet{
+			Tags:     []string{"host:web2"},
+			Messages: []plexer.Message{{ID: "cpu_used", Data: "0.75", Value: 0.75}},
+		})
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/stream?stat=cpu_used&host=web1", apiAddr), nil)
+	req.Header.Add("X-AUTH-TOKEN", "")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected content type '%s'", res.Header.Get("Content-Type"))
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go publishStats(done)
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "data: ") || !strings.Contains(line, `"id":"cpu_used"`) || !strings.Contains(line, `"host:web1"`) || !strings.Contains(line, `"value":0.25`) {
+		t.Errorf("%s doesn't match expected out", line)
+	}
+}
+
+func TestStreamWebsocket(t *testing.T) {
+	header := http.Header{}
+	header.Add("X-AUTH-TOKEN", "")
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/stream?host=web2", apiAddr), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go publishStats(done)
+
+	var stat struct {
+		ID    string   `json:"id"`
+		Tags  []string `json:"tags"`
+		Value float64  `json:"value"`
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.ID != "cpu_used" || stat.Value != 0.75 || len(stat.Tags) != 1 || stat.Tags[0] != "host:web2" {
+		t.Errorf("%+v doesn't match expected out", stat)
+	}
+}
+
 func TestAddAlert(t *testing.T) {
 	if !kap {
 		t.SkipNow()
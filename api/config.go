@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/nanopack/pulse/server"
+)
+
+// add or update the desired setting of a relay's collector
+func setConfig(res http.ResponseWriter, req *http.Request) {
+	host := req.URL.Query().Get(":host")
+	collector := req.URL.Query().Get(":collector")
+
+	// enabled defaults to true so setting just an interval doesn't disable it
+	var body struct {
+		Enabled  *bool `json:"enabled"`
+		Interval int   `json:"interval"`
+	}
+	err := parseBody(req, &body)
+	if err != nil {
+		writeBody(apiError{ErrorString: err.Error()}, res, http.StatusBadRequest, req)
+		return
+	}
+
+	setting := server.Setting{Enabled: true, Interval: body.Interval}
+	if body.Enabled != nil {
+		setting.Enabled = *body.Enabled
+	}
+
+	err = server.Configure(host, collector, setting)
+	if err != nil {
+		writeBody(apiError{ErrorString: err.Error()}, res, http.StatusBadRequest, req)
+		return
+	}
+
+	writeBody(setting, res, http.StatusOK, req)
+}
+
+// get the desired settings of all relays' collectors
+func getConfig(res http.ResponseWriter, req *http.Request) {
+	writeBody(server.Settings(), res, http.StatusOK, req)
+}
@@ -7,15 +7,32 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jcelliott/lumber"
 	"github.com/spf13/viper"
 
 	"github.com/nanopack/pulse/influx"
+	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/server"
 )
 
 type (
+	// publishersStats is how the publishers are keeping up
+	publishersStats struct {
+		Publishers []plexer.PublisherInfo `json:"publishers"`
+		Spool      *spoolStats            `json:"spool,omitempty"`
+	}
+
+	// spoolStats is what's waiting in the spool for influx
+	spoolStats struct {
+		Depth        int   `json:"depth"`
+		Size         int64 `json:"size"`
+		Dropped      int   `json:"dropped"`
+		DeadLettered int   `json:"dead_lettered"`
+	}
+
 	point struct {
 		Time  int64   `json:"time"`
 		Value float64 `json:"value"`
@@ -78,6 +95,93 @@ func tagsRequest(res http.ResponseWriter, req *http.Request) {
 	writeBody(tags, res, http.StatusOK, req)
 }
 
+// return the collection failures relays reported, per host and collector
+func failuresRequest(res http.ResponseWriter, req *http.Request) {
+	writeBody(server.Failures(), res, http.StatusOK, req)
+}
+
+// return each publisher's stats, and the spool's when spooling
+func publishersRequest(res http.ResponseWriter, req *http.Request) {
+	stats := publishersStats{Publishers: []plexer.PublisherInfo{}}
+	if Plex != nil {
+		stats.Publishers = Plex.Publishers()
+	}
+	if Spool != nil {
+		stats.Spool = &spoolStats{
+			Depth:        Spool.Depth(),
+			Size:         Spool.Size(),
+			Dropped:      Spool.Dropped(),
+			DeadLettered: Spool.DeadLettered(),
+		}
+	}
+	writeBody(stats, res, http.StatusOK, req)
+}
+
+var (
+	// FieldCacheTTL is how long the measurements fields are in are cached
+	// for, rather than asking influx on every request
+	FieldCacheTTL = time.Minute
+
+	fieldCache     map[string][]string // field to the measurements it's in
+	fieldCacheTime time.Time
+	fieldCacheLock sync.Mutex
+)
+
+// measurementsOf returns the measurements a field is in, from the cache
+// unless it's stale
+func measurementsOf(stat string) ([]string, error) {
+	fieldCacheLock.Lock()
+	defer fieldCacheLock.Unlock()
+
+	if fieldCache != nil && time.Since(fieldCacheTime) < FieldCacheTTL {
+		return fieldCache[stat], nil
+	}
+
+	cols, err := influx.Query("SHOW FIELD KEYS FROM one_day./.*/")
+	if err != nil {
+		return nil, err
+	}
+	fieldCache = map[string][]string{}
+	fieldCacheTime = time.Now()
+	for _, result := range cols.Results {
+		for _, series := range result.Series {
+			for _, val := range series.Values {
+				if field, ok := val[0].(string); ok {
+					fieldCache[field] = append(fieldCache[field], series.Name)
+				}
+			}
+		}
+	}
+	return fieldCache[stat], nil
+}
+
+// measurementOf finds the measurement a stat (field) is stored in. Stats are
+// their own measurement unless a name template made them a field of another
+// (eg. field "read" of measurement "disk").
+func measurementOf(stat string) (string, error) {
+	found, err := measurementsOf(stat)
+	if err != nil {
+		return "", err
+	}
+
+	measurements := []string{}
+	for _, measurement := range found {
+		if measurement == stat {
+			return stat, nil
+		}
+		measurements = append(measurements, measurement)
+	}
+
+	switch len(measurements) {
+	case 0:
+		// nothing's been stored yet, it will be its own
+		return stat, nil
+	case 1:
+		return measurements[0], nil
+	}
+	return "", AmbiguousStat
+}
+
 // fetches the latest stat for either a single filter (eg. host) or the average of multiple
 func latestStat(res http.ResponseWriter, req *http.Request) {
 	// todo: prevent sql(like)-injection (start secure, its their own private stat db otherwise)
@@ -99,7 +203,7 @@ func latestStat(res http.ResponseWriter, req *http.Request) {
 	// filters holds the influxDB language for the WHERE clause
 	filters := []string{}
 	for key, val := range req.URL.Query() {
-		if key == ":stat" || key == "verb" || key == "start" || key == "stop" || key == "backfill" || key == "x-auth-token" || key == "X-AUTH-TOKEN" {
+		if key == ":stat" || key == "verb" || key == "measurement" || key == "start" || key == "stop" || key == "backfill" || key == "x-auth-token" || key == "X-AUTH-TOKEN" {
 			continue
 		}
 		if len(val) > 1 {
@@ -136,8 +240,23 @@ func latestStat(res http.ResponseWriter, req *http.Request) {
 		query = fmt.Sprintf(`SELECT %s("%s")`, verb, stat)
 	}
 
+	// stats named by a template are fields of another measurement
+	measurement := req.URL.Query().Get("measurement")
+	if measurement == "" {
+		var err error
+		measurement, err = measurementOf(stat)
+		if err == AmbiguousStat {
+			writeBody(apiError{ErrorString: err.Error()}, res, http.StatusBadRequest, req)
+			return
+		}
+		if err != nil {
+			writeBody(apiError{ErrorString: err.Error()}, res, http.StatusInternalServerError, req)
+			return
+		}
+	}
+
 	// add the FROM to the query
-	query = fmt.Sprintf(`%s FROM "%s"`, query, stat)
+	query = fmt.Sprintf(`%s FROM "%s"`, query, measurement)
 
 	// grab the latest chunk (poll interval used so we don't have too many results)
 	// allow missing 1 stat update (we have to sacrifice accuracy because influx
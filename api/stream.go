@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jcelliott/lumber"
+	"github.com/spf13/viper"
+
+	"github.com/nanopack/pulse/plexer"
+)
+
+type (
+	// streamStat is a live stat as it's sent to streaming clients
+	streamStat struct {
+		ID    string      `json:"id"`
+		Field string      `json:"field,omitempty"`
+		Tags  []string    `json:"tags"`
+		Value interface{} `json:"value"`
+		Time  int64       `json:"time"`
+	}
+
+	// subscriber is a client streaming stats
+	subscriber struct {
+		stats []string            // stat ids wanted, all when empty
+		tags  map[string][]string // tag key to the values wanted, every key must match
+		feed  chan streamStat
+	}
+)
+
+var (
+	// StreamBuffer is how many stats a slow client may fall behind by before
+	// it misses some
+	StreamBuffer = 256
+
+	subscribers = map[*subscriber]bool{}
+	subLock     sync.RWMutex
+
+	upgrader = websocket.Upgrader{
+		CheckOrigin: func(req *http.Request) bool {
+			allow := viper.GetString("cors-allow")
+			return allow == "*" || allow == req.Header.Get("Origin")
+		},
+	}
+)
+
+// Publish sends live stats to the clients streaming them, it is a
+// plexer.BatchPublisher
+func Publish(messages plexer.MessageSet) error {
+	subLock.RLock()
+	defer subLock.RUnlock()
+
+	if len(subscribers) == 0 {
+		return nil
+	}
+
+	for _, message := range messages.Messages {
+		stat := streamStat{
+			ID:    message.ID,
+			Field: message.Field,
+			Tags:  append(append([]string{}, messages.Tags...), message.Tags...),
+			Value: message.Value,
+			Time:  message.Time.Unix(),
+		}
+		if stat.Value == nil {
+			stat.Value = message.Data
+		}
+		if message.Time.IsZero() {
+			stat.Time = time.Now().Unix()
+		}
+
+		for sub := range subscribers {
+			if !sub.wants(stat) {
+				continue
+			}
+			select {
+			case sub.feed <- stat:
+			default:
+				// don't hold up publishing for a slow client
+			}
+		}
+	}
+	return nil
+}
+
+// newSubscriber reads the filters from the query, 'stat' picks stats and
+// every other parameter is a tag filter (eg. ?stat=cpu_used&host=web1)
+func newSubscriber(req *http.Request) *subscriber {
+	sub := &subscriber{tags: map[string][]string{}, feed: make(chan streamStat, StreamBuffer)}
+	for key, values := range req.URL.Query() {
+		switch {
+		case key == "stat":
+			sub.stats = values
+		case strings.EqualFold(key, "X-AUTH-TOKEN"):
+			// not a filter
+		default:
+			sub.tags[key] = values
+		}
+	}
+	return sub
+}
+
+// wants reports whether the stat passes the subscriber's filters
+func (sub *subscriber) wants(stat streamStat) bool {
+	if len(sub.stats) > 0 && !contains(sub.stats, stat.ID) {
+		return false
+	}
+	for key, values := range sub.tags {
+		found := false
+		for _, tag := range stat.Tags {
+			if strings.HasPrefix(tag, key+":") && contains(values, strings.TrimPrefix(tag, key+":")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe starts feeding the subscriber
+func subscribe(sub *subscriber) {
+	subLock.Lock()
+	subscribers[sub] = true
+	subLock.Unlock()
+}
+
+// unsubscribe stops feeding the subscriber
+func unsubscribe(sub *subscriber) {
+	subLock.Lock()
+	delete(subscribers, sub)
+	subLock.Unlock()
+}
+
+// stream live stats over a websocket or, failing that, server-sent events
+func streamStats(res http.ResponseWriter, req *http.Request) {
+	sub := newSubscriber(req)
+
+	if websocket.IsWebSocketUpgrade(req) {
+		streamWebsocket(res, req, sub)
+		return
+	}
+
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		writeBody(apiError{ErrorString: "Streaming unsupported"}, res, http.StatusInternalServerError, req)
+		return
+	}
+
+	subscribe(sub)
+	defer unsubscribe(sub)
+
+	lumber.Debug("[PULSE :: API] Streaming stats to %s over SSE", req.RemoteAddr)
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// keep idle connections (and proxies) from timing out
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case stat := <-sub.feed:
+			b, err := json.Marshal(stat)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(res, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// streamWebsocket sends each stat as a json message until the client leaves
+func streamWebsocket(res http.ResponseWriter, req *http.Request, sub *subscriber) {
+	conn, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		// the upgrader has already responded
+		lumber.Debug("[PULSE :: API] Failed to upgrade to websocket - %s", err)
+		return
+	}
+	defer conn.Close()
+
+	subscribe(sub)
+	defer unsubscribe(sub)
+
+	lumber.Debug("[PULSE :: API] Streaming stats to %s over websocket", req.RemoteAddr)
+
+	// clients don't send anything, but reading notices when they leave
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case stat := <-sub.feed:
+			if err := conn.WriteJSON(stat); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
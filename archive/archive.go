@@ -0,0 +1,339 @@
+// Package archive provides a batch publisher writing every stat to rotating,
+// gzipped JSON lines or CSV files, as an audit trail and raw archive kept
+// independently of influx's retention policies.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/pulse/plexer"
+)
+
+var (
+	BadFormat     = errors.New("Archive format must be 'jsonl' or 'csv'")
+	ArchiveClosed = errors.New("The archive is closed")
+
+	// DefaultOptions are used for any Options left zero
+	DefaultOptions = Options{
+		Format:  "jsonl",
+		Prefix:  "pulse",
+		MaxSize: 64 << 20,
+		MaxAge:  time.Hour,
+	}
+
+	// CSVHeader names the columns of csv archives
+	CSVHeader = []string{"time", "id", "field", "tags", "type", "value"}
+)
+
+// nameTime is how a file's name records when it was started
+const nameTime = "20060102T150405.000000000"
+
+type (
+	// Options pick the archive's format and when files are rotated: once
+	// MaxSize bytes (before compression) are written or MaxAge has passed.
+	// Files older than Retention are deleted, none are when it's zero.
+	Options struct {
+		Format    string
+		Prefix    string
+		MaxSize   int64
+		MaxAge    time.Duration
+		Retention time.Duration
+	}
+
+	// Record is an archived stat, one per line of a jsonl archive
+	Record struct {
+		Time  time.Time   `json:"time"`
+		ID    string      `json:"id"`
+		Field string      `json:"field,omitempty"`
+		Tags  []string    `json:"tags"`
+		Type  string      `json:"type"` // float, integer, boolean or string
+		Value interface{} `json:"value"`
+	}
+
+	// Archive writes stats to rotating files in a directory
+	Archive struct {
+		dir  string
+		opts Options
+
+		mu      sync.Mutex
+		file    *os.File
+		gz      *gzip.Writer
+		csv     *csv.Writer
+		written int64
+		started time.Time
+		closed  bool
+	}
+
+	// counter counts the bytes written through it
+	counter struct {
+		w io.Writer
+		n *int64
+	}
+)
+
+// New creates an archive writing to dir
+func New(dir string, opts Options) (*Archive, error) {
+	if opts.Format == "" {
+		opts.Format = DefaultOptions.Format
+	}
+	if opts.Format != "jsonl" && opts.Format != "csv" {
+		return nil, BadFormat
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultOptions.Prefix
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultOptions.MaxSize
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = DefaultOptions.MaxAge
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Archive{dir: dir, opts: opts}, nil
+}
+
+func (c counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// Publish archives the message set, it is a plexer.BatchPublisher
+func (a *Archive) Publish(messages plexer.MessageSet) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return ArchiveClosed
+	}
+
+	for _, message := range messages.Messages {
+		if a.file == nil || a.written >= a.opts.MaxSize || time.Since(a.started) >= a.opts.MaxAge {
+			if err := a.rotate(); err != nil {
+				return err
+			}
+		}
+		if err := a.write(NewRecord(messages, message)); err != nil {
+			return err
+		}
+	}
+
+	if a.file == nil {
+		return nil
+	}
+	if a.csv != nil {
+		a.csv.Flush()
+		if err := a.csv.Error(); err != nil {
+			return err
+		}
+	}
+	// make what's written so far readable, even if pulse dies
+	return a.gz.Flush()
+}
+
+// NewRecord makes the archive record of a message in a set
+func NewRecord(messages plexer.MessageSet, message plexer.Message) Record {
+	r := Record{
+		Time:  message.Time,
+		ID:    message.ID,
+		Field: message.Field,
+		Tags:  append(append([]string{}, messages.Tags...), message.Tags...),
+		Value: message.Value,
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	switch message.Value.(type) {
+	case float64:
+		r.Type = "float"
+	case int64:
+		r.Type = "integer"
+	case bool:
+		r.Type = "boolean"
+	case string:
+		r.Type = "string"
+	default:
+		// untyped, keep it as a number when it is one
+		if f, err := strconv.ParseFloat(message.Data, 64); err == nil {
+			r.Type, r.Value = "float", f
+		} else {
+			r.Type, r.Value = "string", message.Data
+		}
+	}
+	return r
+}
+
+// ParseRecord reads a jsonl record, keeping numbers as they were written so
+// integers past 2^53 aren't rounded through a float
+func ParseRecord(line []byte) (Record, error) {
+	var r Record
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	err := decoder.Decode(&r)
+	return r, err
+}
+
+// Message turns the record back into a message, tags and all
+func (r Record) Message() plexer.Message {
+	message := plexer.Message{ID: r.ID, Field: r.Field, Tags: r.Tags, Time: r.Time, Value: r.Value}
+
+	// numbers come back as json.Numbers (see ParseRecord), or floats
+	switch v := r.Value.(type) {
+	case json.Number:
+		if r.Type == "integer" {
+			if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				message.Value = i
+				break
+			}
+		}
+		message.Value, _ = strconv.ParseFloat(string(v), 64)
+	case float64:
+		if r.Type == "integer" {
+			message.Value = int64(v)
+		}
+	}
+
+	switch v := message.Value.(type) {
+	case float64:
+		message.Data = strconv.FormatFloat(v, 'g', -1, 64)
+	case int64:
+		message.Data = strconv.FormatInt(v, 10)
+	case bool:
+		message.Data = strconv.FormatBool(v)
+	case string:
+		message.Data = v
+	}
+	return message
+}
+
+// write writes a record to the current file, the caller must hold the lock
+func (a *Archive) write(r Record) error {
+	if a.csv == nil {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = counter{a.gz, &a.written}.Write(append(b, '\n'))
+		return err
+	}
+
+	value := fmt.Sprint(r.Value)
+	if f, ok := r.Value.(float64); ok {
+		value = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	row := []string{r.Time.UTC().Format(time.RFC3339Nano), r.ID, r.Field, strings.Join(r.Tags, ","), r.Type, value}
+	for _, column := range row {
+		a.written += int64(len(column) + 1)
+	}
+	return a.csv.Write(row)
+}
+
+// rotate closes the current file and starts a new one, the caller must hold
+// the lock
+func (a *Archive) rotate() error {
+	if err := a.closeFile(); err != nil {
+		lumber.Error("[PULSE :: ARCHIVE] Failed to close archive - %s", err)
+	}
+
+	a.started = time.Now()
+	name := fmt.Sprintf("%s-%s.%s.gz", a.opts.Prefix, a.started.UTC().Format(nameTime), a.opts.Format)
+	f, err := os.OpenFile(filepath.Join(a.dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	lumber.Trace("[PULSE :: ARCHIVE] Archiving to %s", name)
+
+	a.file = f
+	a.gz = gzip.NewWriter(f)
+	a.written = 0
+	if a.opts.Format == "csv" {
+		a.csv = csv.NewWriter(a.gz)
+		if err := a.csv.Write(CSVHeader); err != nil {
+			return err
+		}
+	}
+
+	a.prune()
+	return nil
+}
+
+// closeFile finishes the current file, the caller must hold the lock
+func (a *Archive) closeFile() error {
+	if a.file == nil {
+		return nil
+	}
+	if a.csv != nil {
+		a.csv.Flush()
+	}
+	err := a.gz.Close()
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.file, a.gz, a.csv = nil, nil, nil
+	return err
+}
+
+// Files lists the archive's files, oldest first
+func (a *Archive) Files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(a.dir, a.opts.Prefix+"-*."+a.opts.Format+".gz"))
+	if err != nil {
+		return nil, err
+	}
+	// names start with when the file was started
+	sort.Strings(files)
+	return files, nil
+}
+
+// prune deletes files past the retention, never the one being written
+func (a *Archive) prune() {
+	if a.opts.Retention <= 0 {
+		return
+	}
+	files, err := a.Files()
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if a.file != nil && file == a.file.Name() {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil || time.Since(info.ModTime()) < a.opts.Retention {
+			continue
+		}
+		lumber.Trace("[PULSE :: ARCHIVE] Removing expired archive %s", file)
+		os.Remove(file)
+	}
+}
+
+// Close finishes the file being written
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.closeFile()
+}
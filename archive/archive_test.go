@@ -0,0 +1,206 @@
+package archive_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nanopack/pulse/archive"
+	"github.com/nanopack/pulse/plexer"
+)
+
+var stats = plexer.MessageSet{Tags: []string{"host:web1"}, Messages: []plexer.Message{
+	{ID: "cpu_used", Tags: []string{"cpu:0"}, Data: "0.34", Value: 0.34},
+	{ID: "requests", Data: "42", Value: int64(42)},
+	{ID: "healthy", Data: "true", Value: true},
+	{ID: "version", Data: "1.2", Value: "1.2"},
+	{ID: "ram_used", Data: "0.5"},
+}}
+
+// lines reads the lines of a gzipped file
+func lines(t *testing.T, file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Failed to open archive - %s", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to read archive - %s", err)
+	}
+	rtn := []string{}
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		rtn = append(rtn, scanner.Text())
+	}
+	return rtn
+}
+
+func TestJSONL(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(dir)
+
+	arch, err := archive.New(dir, archive.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create archive - %s", err)
+	}
+	if err := arch.Publish(stats); err != nil {
+		t.Fatalf("Failed to archive - %s", err)
+	}
+	arch.Close()
+	if err := arch.Publish(stats); err != archive.ArchiveClosed {
+		t.Errorf("Expected a closed archive, got %v", err)
+	}
+
+	files, _ := arch.Files()
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 archive, got %v", files)
+	}
+	got := lines(t, files[0])
+	if len(got) != len(stats.Messages) {
+		t.Fatalf("Expected %d records, got %d", len(stats.Messages), len(got))
+	}
+
+	messages := []plexer.Message{}
+	for _, line := range got {
+		record, err := archive.ParseRecord([]byte(line))
+		if err != nil {
+			t.Fatalf("Bad record '%s' - %s", line, err)
+		}
+		messages = append(messages, record.Message())
+	}
+	if len(messages[0].Tags) != 2 || messages[0].Tags[0] != "host:web1" || messages[0].Tags[1] != "cpu:0" {
+		t.Errorf("Tags weren't archived - %v", messages[0].Tags)
+	}
+	if messages[0].Value != 0.34 || messages[1].Value != int64(42) || messages[2].Value != true || messages[3].Value != "1.2" {
+		t.Errorf("Values lost their types - %+v", messages)
+	}
+	if messages[4].Value != 0.5 || messages[4].Data != "0.5" {
+		t.Errorf("Untyped value wasn't archived as a float - %+v", messages[4])
+	}
+
+	// integers too big for a float keep every digit
+	big := plexer.Message{ID: "bytes", Data: "9007199254740993", Value: int64(9007199254740993)}
+	line, _ := json.Marshal(archive.NewRecord(stats, big))
+	record, err := archive.ParseRecord(line)
+	if err != nil {
+		t.Fatalf("Bad record '%s' - %s", line, err)
+	}
+	if message := record.Message(); message.Value != int64(9007199254740993) || message.Data != "9007199254740993" {
+		t.Errorf("Integer lost precision - %+v", message)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(dir)
+
+	if _, err := archive.New(dir, archive.Options{Format: "xml"}); err != archive.BadFormat {
+		t.Errorf("Expected a bad format, got %v", err)
+	}
+
+	arch, err := archive.New(dir, archive.Options{Format: "csv"})
+	if err != nil {
+		t.Fatalf("Failed to create archive - %s", err)
+	}
+	arch.Publish(stats)
+
+	// what's published is readable before the file is closed
+	files, _ := arch.Files()
+	if len(files) != 1 || filepath.Ext(files[0]) != ".gz" {
+		t.Fatalf("Expected 1 archive, got %v", files)
+	}
+	f, _ := os.Open(files[0])
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to read archive - %s", err)
+	}
+	// the file isn't finished, so read rows until it ends abruptly
+	rows := [][]string{}
+	reader := csv.NewReader(gz)
+	for row, err := reader.Read(); err == nil; row, err = reader.Read() {
+		rows = append(rows, row)
+	}
+	f.Close()
+	arch.Close()
+
+	if len(rows) != len(stats.Messages)+1 || rows[0][0] != "time" {
+		t.Fatalf("Unexpected rows - %v", rows)
+	}
+	if row := rows[1]; row[1] != "cpu_used" || row[3] != "host:web1,cpu:0" || row[4] != "float" || row[5] != "0.34" {
+		t.Errorf("Unexpected row - %v", row)
+	}
+	if row := rows[2]; row[4] != "integer" || row[5] != "42" {
+		t.Errorf("Unexpected row - %v", row)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(dir)
+
+	arch, err := archive.New(dir, archive.Options{MaxSize: 300})
+	if err != nil {
+		t.Fatalf("Failed to create archive - %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		arch.Publish(stats)
+	}
+	arch.Close()
+
+	files, _ := arch.Files()
+	if len(files) < 3 {
+		t.Fatalf("Expected the archive to rotate by size, got %v", files)
+	}
+	total := 0
+	for _, file := range files {
+		total += len(lines(t, file))
+	}
+	if total != 3*len(stats.Messages) {
+		t.Errorf("Expected %d records, got %d", 3*len(stats.Messages), total)
+	}
+
+	arch, _ = archive.New(dir, archive.Options{MaxAge: time.Millisecond * 10})
+	defer arch.Close()
+	arch.Publish(stats)
+	time.Sleep(time.Millisecond * 20)
+	arch.Publish(stats)
+	if rotated, _ := arch.Files(); len(rotated) != len(files)+2 {
+		t.Errorf("Expected the archive to rotate by age, got %v", rotated)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "archive")
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "pulse-20160101T000000.000000000.jsonl.gz")
+	ioutil.WriteFile(old, nil, 0644)
+	os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+	other := filepath.Join(dir, "notes.txt")
+	ioutil.WriteFile(other, nil, 0644)
+	os.Chtimes(other, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+
+	arch, err := archive.New(dir, archive.Options{Retention: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create archive - %s", err)
+	}
+	defer arch.Close()
+	arch.Publish(stats)
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expired archive wasn't removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Removed a file that isn't an archive - %s", err)
+	}
+	if files, _ := arch.Files(); len(files) != 1 {
+		t.Errorf("Expected only the current archive, got %v", files)
+	}
+}
@@ -49,16 +49,18 @@ func Insert(messageSet plexer.MessageSet) error {
 			tags[elems[0]] = elems[1]
 		}
 
-		// if there
-		value, err := strconv.ParseFloat(message.Data, 64)
-		if err != nil {
-			value = -1
-		}
-
 		// only one field per set of message tags.
-		field := map[string]interface{}{message.ID: value}
-		// create a point
-		point, err := client.NewPoint(message.ID, tags, field, time.Now())
+		key := message.Field
+		if key == "" {
+			key = message.ID
+		}
+		field := map[string]interface{}{key: fieldValue(message)}
+		// create a point, stamped with when it was collected
+		stamp := message.Time
+		if stamp.IsZero() {
+			stamp = time.Now()
+		}
+		point, err := client.NewPoint(message.ID, tags, field, stamp)
 		if err != nil {
 			continue
 		}
@@ -67,6 +69,19 @@ func Insert(messageSet plexer.MessageSet) error {
 	return writePoints("statistics", "one_day", points)
 }
 
+// fieldValue returns the message's typed value, falling back to its data as
+// a float or, failing that, a string
+func fieldValue(message plexer.Message) interface{} {
+	if message.Value != nil {
+		return message.Value
+	}
+	value, err := strconv.ParseFloat(message.Data, 64)
+	if err != nil {
+		return message.Data
+	}
+	return value
+}
+
 func writePoints(database, retain string, points []*client.Point) error {
 	// Create a new point batch
 	batchPoint, _ := client.NewBatchPoints(client.BatchPointsConfig{
@@ -82,7 +97,24 @@ func writePoints(database, retain string, points []*client.Point) error {
 	if err != nil {
 		return err
 	}
-	return c.Write(batchPoint)
+	return classify(c.Write(batchPoint))
+}
+
+// rejections are what influx answers (with a 400) for writes it will never
+// take, unlike network errors or a busy influx
+var rejections = []string{"partial write", "unable to parse", "field type conflict"}
+
+// classify marks write errors influx will never take as permanent
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, rejection := range rejections {
+		if strings.Contains(err.Error(), rejection) {
+			return plexer.Permanent(err)
+		}
+	}
+	return err
 }
 
 func influxClient() (client.Client, error) {
@@ -166,11 +198,16 @@ func KeepContinuousQueriesUpToDate() error {
 		}
 		group := slicify(grp)
 
-		// populate current columns
+		// populate current columns, only numbers can be averaged
 		clm := map[string]bool{}
 		for _, res := range cols.Results {
 			for _, series := range res.Series {
 				for _, val := range series.Values {
+					if len(val) > 1 {
+						if fieldType, _ := val[1].(string); fieldType != "float" && fieldType != "integer" {
+							continue
+						}
+					}
 					clm[val[0].(string)] = true
 				}
 			}
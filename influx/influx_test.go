@@ -51,7 +51,8 @@ func TestInsert(t *testing.T) {
 	// define fake messages
 	msg1 := plexer.Message{ID: "cpu_used", Tags: []string{"cpu_not_free"}, Data: "0.34"}
 	msg2 := plexer.Message{ID: "ram_used", Tags: []string{"ram_not_free"}, Data: "0.43"}
-	messages := plexer.MessageSet{Tags: []string{"host:tester", "test0"}, Messages: []plexer.Message{msg1, msg2}}
+	msg3 := plexer.Message{ID: "version", Tags: []string{}, Data: "1.2", Value: "1.2"}
+	messages := plexer.MessageSet{Tags: []string{"host:tester", "test0"}, Messages: []plexer.Message{msg1, msg2, msg3}}
 
 	// test inserting into influx
 	if err := influx.Insert(messages); err != nil {
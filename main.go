@@ -10,9 +10,21 @@
 // For more specific usage information, refer to the help doc `pulse -h`:
 //  Usage:
 //    pulse [flags]
+//    pulse [command]
+//
+//  Available Commands:
+//    replay      Replay archived stats (or captured relay traffic) to the configured publishers
 //
 //  Flags:
 //    -a, --aggregate-interval int         Interval at which stats are aggregated (default 15)
+//        --archive-dir string             Directory to archive every stat in
+//        --archive-format string          Format of archived stats, 'jsonl' or 'csv' (default "jsonl")
+//        --archive-max-size int           Megabytes to archive to a file before starting another (default 64)
+//        --archive-retention int          Days to keep archived stats, 0 keeps them forever (default 30)
+//        --archive-rotate int             Minutes to archive to a file before starting another (default 60)
+//        --batch-flush-on-close           Store stats still batching on shutdown (default true)
+//        --batch-interval int             Seconds to batch stats for before storing them (default 5)
+//        --batch-size int                 Number of stats to batch before storing them (default 5000)
 //    -c, --config-file string              Config file location for server
 //    -C, --cors-allow string              Sets the 'Access-Control-Allow-Origin' header (default "*")
 //    -H, --http-listen-address string     Http listen address (default "127.0.0.1:8080")
@@ -25,6 +37,8 @@
 //    -p, --poll-interval int              Interval to request stats from clients (default 60)
 //    -s, --server                         Run as server
 //    -S, --server-listen-address string   Server listen address (default "127.0.0.1:3000")
+//        --spool-dir string               Directory to spool stats in while influx is unreachable
+//        --spool-max-size int             Megabytes of stats to spool before dropping the oldest (default 1024)
 //    -t, --token string                   Security token (recommend placing in config file) (default "secret")
 //    -v, --version                        Print version info and exit
 //
@@ -32,6 +46,10 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jcelliott/lumber"
@@ -40,10 +58,14 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/nanopack/pulse/api"
+	"github.com/nanopack/pulse/archive"
 	"github.com/nanopack/pulse/influx"
 	"github.com/nanopack/pulse/kapacitor"
 	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/replay"
 	pulse "github.com/nanopack/pulse/server"
+	"github.com/nanopack/pulse/spool"
+	"github.com/nanopack/pulse/webhook"
 )
 
 var (
@@ -63,10 +85,25 @@ var (
 	beatInterval      = 30 // heartbeat frequency (seconds)
 	aggregateInterval = 15
 	retention         = 1
+	batchSize         = 5000
+	batchInterval     = 5 // seconds
+	batchFlushOnClose = true
+	spoolDir          = ""
+	spoolMaxSize      = 1024 // megabytes
+	archiveDir        = ""
+	archiveFormat     = "jsonl"
+	archiveMaxSize    = 64 // megabytes
+	archiveRotate     = 60 // minutes
+	archiveRetention  = 30 // days
 
 	configFile = ""
 	version    = false
 
+	replayFormat = "jsonl"
+	replaySpeed  = 0.0
+	replayShift  = ""
+	replayNow    = false
+
 	// Pulse is the pulse cli
 	Pulse = &cobra.Command{
 		Use:   "pulse",
@@ -80,6 +117,21 @@ var (
 		SilenceUsage:      true,
 	}
 
+	// Replay re-publishes archived stats or captured relay traffic
+	Replay = &cobra.Command{
+		Use:   "replay [files...]",
+		Short: "Replay archived stats (or captured relay traffic) to the configured publishers",
+		Long: `Replay publishes the stats in archive files, or in files of what relays sent
+a server, to influx and the webhooks configured for the server (not mist, the
+archive, the stream or the spool). Gzipped files end in '.gz' and '-' reads
+stdin.`,
+
+		Args:          cobra.MinimumNArgs(1),
+		RunE:          replayStats,
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
 	// to be populated by go linker
 	tag    string
 	commit string
@@ -117,10 +169,36 @@ func init() {
 	viper.BindPFlag("retention", Pulse.Flags().Lookup("retention"))
 	Pulse.Flags().IntP("beat-interval", "b", beatInterval, "Heartbeat frequency (seconds)")
 	viper.BindPFlag("beat-interval", Pulse.Flags().Lookup("beat-interval"))
+	Pulse.Flags().Int("batch-size", batchSize, "Number of stats to batch before storing them")
+	viper.BindPFlag("batch-size", Pulse.Flags().Lookup("batch-size"))
+	Pulse.Flags().Int("batch-interval", batchInterval, "Seconds to batch stats for before storing them")
+	viper.BindPFlag("batch-interval", Pulse.Flags().Lookup("batch-interval"))
+	Pulse.Flags().Bool("batch-flush-on-close", batchFlushOnClose, "Store stats still batching on shutdown")
+	viper.BindPFlag("batch-flush-on-close", Pulse.Flags().Lookup("batch-flush-on-close"))
+	Pulse.Flags().String("spool-dir", spoolDir, "Directory to spool stats in while influx is unreachable")
+	viper.BindPFlag("spool-dir", Pulse.Flags().Lookup("spool-dir"))
+	Pulse.Flags().Int("spool-max-size", spoolMaxSize, "Megabytes of stats to spool before dropping the oldest")
+	viper.BindPFlag("spool-max-size", Pulse.Flags().Lookup("spool-max-size"))
+	Pulse.Flags().String("archive-dir", archiveDir, "Directory to archive every stat in")
+	viper.BindPFlag("archive-dir", Pulse.Flags().Lookup("archive-dir"))
+	Pulse.Flags().String("archive-format", archiveFormat, "Format of archived stats, 'jsonl' or 'csv'")
+	viper.BindPFlag("archive-format", Pulse.Flags().Lookup("archive-format"))
+	Pulse.Flags().Int("archive-max-size", archiveMaxSize, "Megabytes to archive to a file before starting another")
+	viper.BindPFlag("archive-max-size", Pulse.Flags().Lookup("archive-max-size"))
+	Pulse.Flags().Int("archive-rotate", archiveRotate, "Minutes to archive to a file before starting another")
+	viper.BindPFlag("archive-rotate", Pulse.Flags().Lookup("archive-rotate"))
+	Pulse.Flags().Int("archive-retention", archiveRetention, "Days to keep archived stats, 0 keeps them forever")
+	viper.BindPFlag("archive-retention", Pulse.Flags().Lookup("archive-retention"))
 
-	Pulse.Flags().StringVarP(&configFile, "config-file", "c", configFile, "Config file location for server")
+	Pulse.PersistentFlags().StringVarP(&configFile, "config-file", "c", configFile, "Config file location for server")
 	Pulse.Flags().BoolVarP(&version, "version", "v", version, "Print version info and exit")
 
+	Replay.Flags().StringVar(&replayFormat, "format", replayFormat, "Format of the files, 'jsonl' (archives) or 'protocol' (relay traffic)")
+	Replay.Flags().Float64Var(&replaySpeed, "speed", replaySpeed, "Replay at this multiple of the original pace, 0 is as fast as possible")
+	Replay.Flags().StringVar(&replayShift, "time-shift", replayShift, "Shift stats' times by this duration (eg. '168h' or '-30m')")
+	Replay.Flags().BoolVar(&replayNow, "now", replayNow, "Stamp stats with the time they're replayed")
+	Pulse.AddCommand(Replay)
+
 	lumber.Level(lumber.LvlInt(viper.GetString("log-level")))
 }
 
@@ -174,20 +252,20 @@ func startPulse(ccmd *cobra.Command, args []string) error {
 	// re-initialize logger
 	lumber.Level(lumber.LvlInt(viper.GetString("log-level")))
 
-	plex := plexer.NewPlexer()
-
-	if viper.GetString("mist-address") != "" {
-		mist, err := mist.New(viper.GetString("mist-address"), viper.GetString("mist-token"))
-		if err != nil {
-			return fmt.Errorf("Mist failed to start - %s", err)
-		}
-		plex.AddObserver("mist", mist.Publish)
-		defer mist.Close()
+	plex, shutdown, err := startPublishers(false)
+	if err != nil {
+		return err
 	}
+	// let publishers finish what's queued when we're done
+	defer shutdown()
+	api.Plex = plex
 
-	plex.AddBatcher("influx", influx.Insert)
+	// a route to a publisher that doesn't exist (eg. a typo) sends stats nowhere
+	if unknown := plex.UnknownRoutes(); len(unknown) > 0 {
+		return fmt.Errorf("Bad routes - no publisher named %s", strings.Join(unknown, ", "))
+	}
 
-	err := pulse.Listen(viper.GetString("server-listen-address"), plex.Publish)
+	err = pulse.Listen(viper.GetString("server-listen-address"), plex.Publish)
 	if err != nil {
 		return fmt.Errorf("Pulse failed to start - %s", err)
 	}
@@ -198,6 +276,165 @@ func startPulse(ccmd *cobra.Command, args []string) error {
 	}
 	go pulse.StartPolling(nil, nil, time.Duration(pollSec)*time.Second, nil)
 
+	err = prepareInflux()
+	if err != nil {
+		return err
+	}
+
+	go influx.KeepContinuousQueriesUpToDate()
+
+	if viper.GetString("kapacitor-address") != "" {
+		err := kapacitor.Init()
+		if err != nil {
+			return fmt.Errorf("Kapacitor failed to start - %s", err)
+		}
+	}
+
+	err = api.Start()
+	if err != nil {
+		return fmt.Errorf("Api failed to start - %s", err)
+	}
+
+	return nil
+}
+
+// startPublishers creates a plexer publishing to everything configured, along
+// with a func that flushes and closes it all. A replay only publishes to
+// influx and webhooks; what's replayed isn't live, is already archived and
+// shouldn't go through the running server's spool.
+func startPublishers(replaying bool) (*plexer.Plexer, func(), error) {
+	plex := plexer.NewPlexer()
+
+	// stores to close once the plexer has handed them what's batching
+	closers := []func() error{}
+
+	// let publishers finish what's queued, then close the stores they were
+	// writing to
+	shutdown := func() {
+		plex.Close()
+		for _, closer := range closers {
+			if err := closer(); err != nil {
+				lumber.Error("[PULSE] Failed to close - %s", err)
+			}
+		}
+	}
+	fail := func(format string, err error) (*plexer.Plexer, func(), error) {
+		shutdown()
+		return nil, nil, fmt.Errorf(format, err)
+	}
+
+	if !replaying && viper.GetString("mist-address") != "" {
+		mist, err := mist.New(viper.GetString("mist-address"), viper.GetString("mist-token"))
+		if err != nil {
+			return fail("Mist failed to start - %s", err)
+		}
+		plex.AddObserver("mist", mist.Publish)
+		closers = append(closers, mist.Close)
+	}
+
+	// spool stats on disk so they survive influx being down
+	insert := plexer.BatchPublisher(influx.Insert)
+	if !replaying && viper.GetString("spool-dir") != "" {
+		spooler, err := spool.New(viper.GetString("spool-dir"), influx.Insert, spool.Options{
+			MaxSize: int64(viper.GetInt("spool-max-size")) << 20,
+		})
+		if err != nil {
+			return fail("Spool failed to start - %s", err)
+		}
+		closers = append(closers, spooler.Close)
+		insert = spooler.Publish
+		api.Spool = spooler
+	}
+
+	// write to influx in batches rather than once per relay response
+	plex.AddBatcherPool("influx", insert, plexer.Pool{
+		BatchSize:      viper.GetInt("batch-size"),
+		BatchInterval:  time.Duration(viper.GetInt("batch-interval")) * time.Second,
+		DiscardOnClose: !viper.GetBool("batch-flush-on-close"),
+	})
+	// live stats for the api's /stream
+	if !replaying {
+		plex.AddBatcher("stream", api.Publish)
+	}
+
+	// keep a raw archive of every stat, whatever influx retains
+	if !replaying && viper.GetString("archive-dir") != "" {
+		arch, err := archive.New(viper.GetString("archive-dir"), archive.Options{
+			Format:    viper.GetString("archive-format"),
+			MaxSize:   int64(viper.GetInt("archive-max-size")) << 20,
+			MaxAge:    time.Duration(viper.GetInt("archive-rotate")) * time.Minute,
+			Retention: time.Duration(viper.GetInt("archive-retention")) * 24 * time.Hour,
+		})
+		if err != nil {
+			return fail("Archive failed to start - %s", err)
+		}
+		closers = append(closers, arch.Close)
+		plex.AddBatcher("archive", arch.Publish)
+	}
+
+	// forward stats to other systems' http endpoints
+	var webhooks []webhook.Config
+	err := viper.UnmarshalKey("webhooks", &webhooks)
+	if err != nil {
+		return fail("Bad webhooks - %s", err)
+	}
+	named := map[string]bool{}
+	for _, config := range webhooks {
+		hook, err := webhook.New(config)
+		if err != nil {
+			return fail("Bad webhooks - %s", err)
+		}
+		if named[hook.Name] {
+			return fail("Bad webhooks - %s", fmt.Errorf("'%s' is configured twice", hook.Name))
+		}
+		named[hook.Name] = true
+		plex.AddBatcher(hook.Name, hook.Publish)
+	}
+
+	// decide which publishers get which stats
+	var routes []plexer.Route
+	err = viper.UnmarshalKey("routes", &routes)
+	if err != nil {
+		return fail("Bad routes - %s", err)
+	}
+	err = plex.SetRoutes(routes)
+	if err != nil {
+		return fail("Bad routes - %s", err)
+	}
+
+	// rewrite stats before they're published
+	var transforms []plexer.Transform
+	err = viper.UnmarshalKey("transforms", &transforms)
+	if err != nil {
+		return fail("Bad transforms - %s", err)
+	}
+	err = plex.SetTransforms(transforms)
+	if err != nil {
+		return fail("Bad transforms - %s", err)
+	}
+
+	// map hierarchical stat names (eg. "disk.sda.read") to measurement, field and tags
+	err = pulse.SetTemplates(viper.GetStringSlice("name-templates"))
+	if err != nil {
+		return fail("Bad name-templates - %s", err)
+	}
+
+	// neither the api nor a replay return when interrupted, so flush on the
+	// way out ourselves
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		lumber.Info("[PULSE] Received %s, flushing publishers...", sig)
+		shutdown()
+		os.Exit(0)
+	}()
+
+	return plex, shutdown, nil
+}
+
+// prepareInflux creates the database and retention policies stats are stored in
+func prepareInflux() error {
 	queries := []string{
 		"CREATE DATABASE statistics",
 		"CREATE RETENTION POLICY one_day ON statistics DURATION 8h REPLICATION 1 DEFAULT",
@@ -210,20 +447,43 @@ func startPulse(ccmd *cobra.Command, args []string) error {
 			return fmt.Errorf("Failed to query influx - %s", err)
 		}
 	}
+	return nil
+}
 
-	go influx.KeepContinuousQueriesUpToDate()
+func replayStats(ccmd *cobra.Command, args []string) error {
+	lumber.Level(lumber.LvlInt(viper.GetString("log-level")))
 
-	if viper.GetString("kapacitor-address") != "" {
-		err := kapacitor.Init()
+	opts := replay.Options{Format: replayFormat, Speed: replaySpeed, Now: replayNow}
+	if replayShift != "" {
+		shift, err := time.ParseDuration(replayShift)
 		if err != nil {
-			return fmt.Errorf("Kapacitor failed to start - %s", err)
+			return fmt.Errorf("Bad time-shift - %s", err)
 		}
+		opts.Shift = shift
 	}
 
-	err = api.Start()
+	plex, shutdown, err := startPublishers(true)
 	if err != nil {
-		return fmt.Errorf("Api failed to start - %s", err)
+		return err
+	}
+	defer shutdown()
+
+	err = prepareInflux()
+	if err != nil {
+		return err
 	}
 
+	for _, path := range args {
+		file, err := replay.Open(path)
+		if err != nil {
+			return fmt.Errorf("Failed to open %s - %s", path, err)
+		}
+		count, err := replay.Replay(file, plex, opts)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to replay %s - %s", path, err)
+		}
+		lumber.Info("[PULSE] Replayed %d stats from %s", count, path)
+	}
 	return nil
 }
@@ -4,6 +4,9 @@ package plexer
 
 import (
 	"errors"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/jcelliott/lumber"
 )
@@ -24,58 +27,216 @@ type (
 		ID   string
 		Tags []string
 		Data string
+		// Value is Data as a float64, int64, bool or string, when known
+		Value interface{}
+		// Field is what the value is stored as within the ID's measurement,
+		// the ID itself when empty
+		Field string
+		// Time is when the value was collected, the time it's stored when zero
+		Time time.Time
 	}
 
 	Plexer struct {
-		batch  map[string]BatchPublisher
-		single map[string]SinglePublisher
+		batch      map[string]*publisher
+		single     map[string]*publisher
+		routes     map[string][]Route // by publisher name
+		transforms []Transform
+		lock       sync.RWMutex // guards all of the above, publishers may come and go while publishing
+	}
+
+	// PublisherInfo describes a registered publisher
+	PublisherInfo struct {
+		Name   string         `json:"name"`
+		Kind   string         `json:"kind"` // "batch" or "single"
+		Pool   Pool           `json:"-"`
+		Stats  PublisherStats `json:"stats"`
+		Routes []Route        `json:"routes,omitempty"`
 	}
 )
 
 func NewPlexer() *Plexer {
 	plex := &Plexer{
-		batch:  make(map[string]BatchPublisher, 0),
-		single: make(map[string]SinglePublisher, 0),
+		batch:  make(map[string]*publisher, 0),
+		single: make(map[string]*publisher, 0),
 	}
 
 	return plex
 }
 
+// AddBatcher adds a batch publisher run on the DefaultPool
 func (plex *Plexer) AddBatcher(name string, observer BatchPublisher) {
+	plex.AddBatcherPool(name, observer, Pool{})
+}
+
+// AddBatcherPool adds a batch publisher run on its own pool, replacing any
+// publisher by that name
+func (plex *Plexer) AddBatcherPool(name string, observer BatchPublisher, pool Pool) {
 	lumber.Trace("[PULSE :: PLEXER] Add batcher: %s...", name)
-	plex.batch[name] = observer
+	plex.add(plex.batch, newPublisher(name, pool, false, func(messages MessageSet) []error {
+		if err := observer(messages); err != nil {
+			return []error{err}
+		}
+		return nil
+	}))
 }
 
+// RemoveBatcher removes a batch publisher once it has published what's queued
 func (plex *Plexer) RemoveBatcher(name string) {
-	lumber.Trace("[PULSE :: PLEXER] Remove batcher: %s...", name)
-	delete(plex.batch, name)
+	if plex.remove(plex.batch, name) {
+		lumber.Trace("[PULSE :: PLEXER] Removed batcher: %s...", name)
+	}
 }
 
+// AddObserver adds a single publisher run on the DefaultPool
 func (plex *Plexer) AddObserver(name string, observer SinglePublisher) {
+	plex.AddObserverPool(name, observer, Pool{})
+}
+
+// AddObserverPool adds a single publisher run on its own pool, replacing any
+// publisher by that name. Each worker publishes a set's messages in order.
+func (plex *Plexer) AddObserverPool(name string, observer SinglePublisher, pool Pool) {
 	lumber.Trace("[PULSE :: PLEXER] Add observer: %s...", name)
-	plex.single[name] = observer
+	plex.add(plex.single, newPublisher(name, pool, true, func(messages MessageSet) []error {
+		var errs []error
+		for _, message := range messages.Messages {
+			tags := append(append([]string{}, message.Tags...), messages.Tags...)
+			if err := observer(append(tags, message.ID), message.Data); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errs
+	}))
 }
 
+// RemoveObserver removes a single publisher once it has published what's queued
 func (plex *Plexer) RemoveObserver(name string) {
-	lumber.Trace("[PULSE :: PLEXER] Remove observer: %s...", name)
-	delete(plex.single, name)
+	if plex.remove(plex.single, name) {
+		lumber.Trace("[PULSE :: PLEXER] Removed observer: %s...", name)
+	}
 }
 
+// Publish transforms the messages and queues them for every publisher their
+// routes let them through to. It returns QueueFull if
+// any publisher is too far behind to take them, the others still get them.
 func (plex *Plexer) Publish(messages MessageSet) error {
+	plex.lock.RLock()
+	defer plex.lock.RUnlock()
 
-	for _, observer := range plex.batch {
-		go observer(messages)
+	return plex.publish(transform(plex.transforms, messages))
+}
+
+// PublishRaw routes the message set to the publishers without transforming
+// it, for stats that were transformed when first published (eg. archived)
+func (plex *Plexer) PublishRaw(messages MessageSet) error {
+	plex.lock.RLock()
+	defer plex.lock.RUnlock()
+
+	return plex.publish(messages)
+}
+
+// publish routes the message set to the publishers, the caller must hold
+// the read lock
+func (plex *Plexer) publish(messages MessageSet) error {
+	if len(messages.Messages) == 0 {
+		return nil
 	}
 
-	for _, observer := range plex.single {
-		for _, message := range messages.Messages {
-			message.Tags = append(message.Tags, messages.Tags...)
-			go observer(append(message.Tags, message.ID), message.Data)
+	var rtn error
+
+	for _, publishers := range []map[string]*publisher{plex.batch, plex.single} {
+		for name, p := range publishers {
+			routed := route(plex.routes[name], messages)
+			if len(routed.Messages) == 0 {
+				continue
+			}
+			if err := p.enqueue(routed); err != nil {
+				lumber.Debug("[PULSE :: PLEXER] %s dropped %d messages - %s", name, len(routed.Messages), err)
+				rtn = err
+			}
+		}
+	}
+	return rtn
+}
+
+// Stats returns the stats of each publisher, by name
+func (plex *Plexer) Stats() map[string]PublisherStats {
+	plex.lock.RLock()
+	defer plex.lock.RUnlock()
+
+	stats := make(map[string]PublisherStats, len(plex.batch)+len(plex.single))
+	for _, publishers := range []map[string]*publisher{plex.batch, plex.single} {
+		for name, p := range publishers {
+			stats[name] = p.snapshot()
+		}
+	}
+	return stats
+}
+
+// Close stops taking messages and waits for every publisher to publish what
+// is already queued
+func (plex *Plexer) Close() error {
+	plex.lock.Lock()
+	stopping := make([]*publisher, 0, len(plex.batch)+len(plex.single))
+	for _, publishers := range []map[string]*publisher{plex.batch, plex.single} {
+		for name, p := range publishers {
+			stopping = append(stopping, p)
+			delete(publishers, name)
 		}
 	}
+	plex.lock.Unlock()
+
+	for _, p := range stopping {
+		p.stop()
+	}
 	return nil
 }
 
+// Publishers lists the registered publishers, sorted by name
+func (plex *Plexer) Publishers() []PublisherInfo {
+	plex.lock.RLock()
+	defer plex.lock.RUnlock()
+
+	infos := make([]PublisherInfo, 0, len(plex.batch)+len(plex.single))
+	for kind, publishers := range map[string]map[string]*publisher{"batch": plex.batch, "single": plex.single} {
+		for name, p := range publishers {
+			infos = append(infos, PublisherInfo{Name: name, Kind: kind, Pool: p.pool, Stats: p.snapshot(), Routes: plex.routes[name]})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Name == infos[j].Name {
+			return infos[i].Kind < infos[j].Kind
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// add registers the publisher, stopping any it replaces
+func (plex *Plexer) add(publishers map[string]*publisher, p *publisher) {
+	plex.lock.Lock()
+	old, ok := publishers[p.name]
+	publishers[p.name] = p
+	plex.lock.Unlock()
+
+	if ok {
+		old.stop()
+	}
+}
+
+// remove unregisters the named publisher and waits for it to publish what's
+// queued, reporting whether there was one
+func (plex *Plexer) remove(publishers map[string]*publisher, name string) bool {
+	plex.lock.Lock()
+	p, ok := publishers[name]
+	delete(publishers, name)
+	plex.lock.Unlock()
+
+	if ok {
+		p.stop()
+	}
+	return ok
+}
+
 func (plex *Plexer) PublishSingle(id string, tags []string, data string) error {
 
 	messages := MessageSet{
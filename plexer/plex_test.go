@@ -1,26 +1,310 @@
 package plexer
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestPlex(test *testing.T) {
 	plex := NewPlexer()
-	count := 0
+	var count int32
 	plex.AddObserver("test", func(tags []string, data string) error {
-		count++
+		atomic.AddInt32(&count, 1)
 		return nil
 	})
 
 	plex.PublishSingle("cpu_used", []string{}, "6")
 	plex.PublishSingle("cpu_used", []string{}, "6")
 	time.Sleep(time.Millisecond * 10)
-	assert(test, count == 2, "publisher was called an incorrect number of times")
+	assert(test, atomic.LoadInt32(&count) == 2, "publisher was called an incorrect number of times")
 	plex.RemoveObserver("test")
 	plex.PublishSingle("cpu_used", []string{}, "6")
 	time.Sleep(time.Millisecond * 10)
-	assert(test, count == 2, "publisher was called an incorrect number of times")
+	assert(test, atomic.LoadInt32(&count) == 2, "publisher was called an incorrect number of times")
+}
+
+func TestPool(test *testing.T) {
+	plex := NewPlexer()
+
+	// a single slow worker with room for one waiting set
+	release := make(chan struct{})
+	var published int32
+	plex.AddBatcherPool("slow", func(messages MessageSet) error {
+		<-release
+		atomic.AddInt32(&published, 1)
+		return nil
+	}, Pool{Workers: 1, Queue: 1})
+
+	var reported int32
+	plex.AddObserverPool("broken", func(tags []string, data string) error {
+		return errors.New("sink unavailable")
+	}, Pool{OnError: func(name string, err error) {
+		atomic.AddInt32(&reported, 1)
+	}})
+
+	assert(test, plex.PublishSingle("cpu_used", []string{}, "6") == nil, "first publish should be taken by the worker")
+	time.Sleep(time.Millisecond * 10)
+	assert(test, plex.PublishSingle("cpu_used", []string{}, "6") == nil, "second publish should be queued")
+	assert(test, plex.PublishSingle("cpu_used", []string{}, "6") == QueueFull, "third publish should report backpressure")
+
+	time.Sleep(time.Millisecond * 10)
+	stats := plex.Stats()
+	assert(test, stats["slow"].Dropped == 1 && stats["slow"].Queued == 1, "unexpected slow stats %+v", stats["slow"])
+	assert(test, stats["broken"].Failed == 3 && stats["broken"].LastError == "sink unavailable", "unexpected broken stats %+v", stats["broken"])
+	assert(test, atomic.LoadInt32(&reported) == 3, "OnError was called %d times", atomic.LoadInt32(&reported))
+
+	// closing waits for what's queued
+	close(release)
+	plex.Close()
+	assert(test, atomic.LoadInt32(&published) == 2, "published %d of the queued sets", atomic.LoadInt32(&published))
+	assert(test, len(plex.Stats()) == 0, "publishers remain after close")
+}
+
+func TestDynamicPublishers(test *testing.T) {
+	plex := NewPlexer()
+	defer plex.Close()
+	plex.AddBatcher("influx", func(MessageSet) error { return nil })
+
+	// attach and detach a tap while stats are being published
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			plex.PublishSingle("cpu_used", []string{}, "6")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("tap%d", i%2)
+			plex.AddObserver(name, func([]string, string) error { return nil })
+			plex.RemoveObserver(name)
+		}
+	}()
+	wg.Wait()
+
+	plex.AddObserver("tap", func([]string, string) error { return nil })
+	publishers := plex.Publishers()
+	assert(test, len(publishers) == 2, "expected 2 publishers, got %+v", publishers)
+	assert(test, publishers[0].Name == "influx" && publishers[0].Kind == "batch", "unexpected publisher %+v", publishers[0])
+	assert(test, publishers[1].Name == "tap" && publishers[1].Kind == "single", "unexpected publisher %+v", publishers[1])
+}
+
+func TestRoutes(test *testing.T) {
+	plex := NewPlexer()
+	defer plex.Close()
+
+	got := map[string]chan MessageSet{"influx": make(chan MessageSet, 10), "mist": make(chan MessageSet, 10)}
+	for name, sets := range got {
+		sets := sets
+		plex.AddBatcher(name, func(messages MessageSet) error {
+			sets <- messages
+			return nil
+		})
+	}
+
+	assert(test, plex.SetRoutes([]Route{{IDs: []string{"cpu"}}}) == BadRoute, "route without publisher should fail")
+	assert(test, plex.SetRoutes([]Route{{Publisher: "mist", IDs: []string{"[cpu"}}}) == BadRoute, "route with bad glob should fail")
+	err := plex.SetRoutes([]Route{
+		{Publisher: "mist", Tags: []string{"host:db*"}},
+		{Publisher: "influx", IDs: []string{"proc_*"}, Drop: true},
+	})
+	assert(test, err == nil, "failed to set routes - %s", err)
+	assert(test, len(plex.UnknownRoutes()) == 0, "registered publishers reported unknown %v", plex.UnknownRoutes())
+
+	plex.Publish(MessageSet{
+		Tags: []string{"host:db1"},
+		Messages: []Message{
+			{ID: "cpu_used", Data: "1"},
+			{ID: "proc_123_cpu", Data: "2"},
+		},
+	})
+	plex.Publish(MessageSet{
+		Tags:     []string{"host:web1"},
+		Messages: []Message{{ID: "cpu_used", Data: "3"}},
+	})
+
+	collect := func(name string, n int) []string {
+		data := []string{}
+		for i := 0; i < n; i++ {
+			select {
+			case messages := <-got[name]:
+				for _, message := range messages.Messages {
+					data = append(data, message.Data)
+				}
+			case <-time.After(time.Second):
+				i = n // give up waiting
+			}
+		}
+		// sets are published concurrently
+		sort.Strings(data)
+		return data
+	}
+
+	influx := collect("influx", 2)
+	assert(test, fmt.Sprint(influx) == "[1 3]", "influx got %v", influx)
+	mist := collect("mist", 1)
+	assert(test, fmt.Sprint(mist) == "[1 2]", "mist got %v", mist)
+	select {
+	case messages := <-got["mist"]:
+		assert(test, false, "mist got unrouted messages %+v", messages)
+	case <-time.After(time.Millisecond * 10):
+	}
+
+	// routes to publishers that don't exist are reported
+	err = plex.SetRoutes([]Route{{Publisher: "influxdb"}, {Publisher: "mist"}, {Publisher: "archive", Drop: true}})
+	assert(test, err == nil, "failed to set routes - %s", err)
+	unknown := plex.UnknownRoutes()
+	assert(test, fmt.Sprint(unknown) == "[archive influxdb]", "expected unknown publishers, got %v", unknown)
+}
+
+func TestTransforms(test *testing.T) {
+	plex := NewPlexer()
+	defer plex.Close()
+
+	sets := make(chan MessageSet, 1)
+	plex.AddBatcher("influx", func(messages MessageSet) error {
+		sets <- messages
+		return nil
+	})
+
+	assert(test, plex.SetTransforms([]Transform{{Action: "shuffle"}}) == BadTransform, "unknown action should fail")
+	assert(test, plex.SetTransforms([]Transform{{Regex: "(", Target: "id"}}) == BadTransform, "bad regex should fail")
+	err := plex.SetTransforms([]Transform{
+		{Action: "drop", Regex: "proc_.*"},
+		{Source: "host", Regex: "(db|web)[0-9]+", Target: "role"},
+		{Regex: "mem_(.*)_bytes", Target: "id", Replacement: "mem_${1}_mb"},
+		{Action: "scale", Regex: "mem_.*_mb", Factor: 1.0 / (1 << 20)},
+		{Action: "tagdrop", Regex: "pid"},
+	})
+	assert(test, err == nil, "failed to set transforms - %s", err)
+
+	original := MessageSet{
+		Tags: []string{"metrics", "host:db1", "pid:12"},
+		Messages: []Message{
+			{ID: "mem_used_bytes", Tags: []string{"pid:12"}, Data: "2097152", Value: int64(2097152)},
+			{ID: "proc_12_cpu", Data: "0.5"},
+			{ID: "cpu_used", Data: "0.25"},
+		},
+	}
+	plex.Publish(original)
+
+	var messages MessageSet
+	select {
+	case messages = <-sets:
+	case <-time.After(time.Second):
+		test.Fatal("nothing was published")
+	}
+
+	assert(test, fmt.Sprint(messages.Tags) == "[metrics host:db1]", "unexpected set tags %v", messages.Tags)
+	assert(test, len(messages.Messages) == 2, "expected proc stats to be dropped %+v", messages.Messages)
+	mem := messages.Messages[0]
+	assert(test, mem.ID == "mem_used_mb" && mem.Data == "2" && mem.Value == 2.0, "unexpected mem message %+v", mem)
+	assert(test, fmt.Sprint(mem.Tags) == "[role:db]", "unexpected mem tags %v", mem.Tags)
+	assert(test, messages.Messages[1].Data == "0.25", "unexpected cpu message %+v", messages.Messages[1])
+
+	// the publisher's copy is transformed, not the caller's
+	assert(test, original.Messages[0].ID == "mem_used_bytes" && len(original.Tags) == 3, "caller's messages were changed")
+
+	// a replaced set tag doesn't linger beside its replacement
+	err = plex.SetTransforms([]Transform{{Source: "host", Regex: "web([0-9]+)", Target: "host", Replacement: "frontend$1"}})
+	assert(test, err == nil, "failed to set transforms - %s", err)
+	plex.Publish(MessageSet{
+		Tags: []string{"metrics", "host:web1"},
+		Messages: []Message{
+			{ID: "cpu_used", Data: "0.25"},
+			{ID: "ram_used", Tags: []string{"host:db2"}, Data: "0.5"},
+		},
+	})
+	select {
+	case messages = <-sets:
+	case <-time.After(time.Second):
+		test.Fatal("nothing was published")
+	}
+	assert(test, fmt.Sprint(messages.Tags) == "[metrics]", "replaced tag was left on the set %v", messages.Tags)
+	assert(test, fmt.Sprint(messages.Messages[0].Tags) == "[host:frontend1]", "unexpected cpu tags %v", messages.Messages[0].Tags)
+	assert(test, fmt.Sprint(messages.Messages[1].Tags) == "[host:db2]", "message's own tag should win %v", messages.Messages[1].Tags)
+
+	// transforms only see the tags earlier ones left
+	err = plex.SetTransforms([]Transform{
+		{Action: "tagdrop", Regex: "host"},
+		{Action: "drop", Source: "host", Regex: "web.*"},
+		{Source: "host", Target: "role", Replacement: "was_$1"},
+	})
+	assert(test, err == nil, "failed to set transforms - %s", err)
+	plex.Publish(MessageSet{Tags: []string{"host:web1"}, Messages: []Message{{ID: "cpu_used", Data: "0.25"}}})
+	select {
+	case messages = <-sets:
+	case <-time.After(time.Second):
+		test.Fatal("stat was dropped by a tag an earlier transform removed")
+	}
+	assert(test, len(messages.Tags) == 0 && len(messages.Messages[0].Tags) == 0, "dropped tag was still seen %+v", messages)
+}
+
+func TestBatching(test *testing.T) {
+	plex := NewPlexer()
+
+	sets := make(chan MessageSet, 10)
+	batcher := func(messages MessageSet) error {
+		sets <- messages
+		return nil
+	}
+	plex.AddBatcherPool("sized", batcher, Pool{BatchSize: 3, BatchInterval: time.Hour})
+
+	publish := func(host string) {
+		plex.Publish(MessageSet{Tags: []string{"host:" + host}, Messages: []Message{{ID: "cpu_used", Data: "1"}, {ID: "ram_used", Data: "2"}}})
+	}
+
+	// a batch is handed over once it's big enough
+	publish("a")
+	select {
+	case messages := <-sets:
+		assert(test, false, "batch published early %+v", messages)
+	case <-time.After(time.Millisecond * 20):
+	}
+	publish("b")
+	select {
+	case messages := <-sets:
+		assert(test, len(messages.Messages) == 4, "expected 4 batched messages, got %+v", messages)
+		assert(test, fmt.Sprint(messages.Messages[2].Tags) == "[host:b]", "set tags weren't kept %+v", messages.Messages[2])
+	case <-time.After(time.Second):
+		assert(test, false, "full batch wasn't published")
+	}
+
+	// or once it's waited long enough
+	plex.AddBatcherPool("timed", batcher, Pool{BatchInterval: time.Millisecond * 20})
+	plex.RemoveBatcher("sized")
+	publish("c")
+	select {
+	case messages := <-sets:
+		assert(test, len(messages.Messages) == 2, "expected 2 batched messages, got %+v", messages)
+	case <-time.After(time.Second):
+		assert(test, false, "batch wasn't published after its interval")
+	}
+
+	// what's gathering is published on close, unless it's to be discarded
+	plex.AddBatcherPool("closing", batcher, Pool{BatchSize: 100, BatchInterval: time.Hour})
+	var discarded int32
+	plex.AddBatcherPool("discarding", func(messages MessageSet) error {
+		atomic.AddInt32(&discarded, 1)
+		return nil
+	}, Pool{BatchSize: 100, BatchInterval: time.Hour, DiscardOnClose: true})
+	plex.RemoveBatcher("timed")
+	publish("d")
+	plex.Close()
+	select {
+	case messages := <-sets:
+		assert(test, len(messages.Messages) == 2, "expected 2 flushed messages, got %+v", messages)
+	default:
+		assert(test, false, "batch wasn't flushed on close")
+	}
+	assert(test, atomic.LoadInt32(&discarded) == 0, "discarded batch was published")
 }
 
 func assert(test *testing.T, check bool, fmt string, args ...interface{}) {
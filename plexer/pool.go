@@ -0,0 +1,263 @@
+package plexer
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	QueueFull        = errors.New("A publisher's queue is full")
+	PublisherStopped = errors.New("The publisher was removed")
+	DefaultPool      = Pool{Workers: 4, Queue: 1024}
+
+	// DefaultBatchInterval is how long a batch waits to fill when only a
+	// BatchSize is given
+	DefaultBatchInterval = 10 * time.Second
+)
+
+type (
+	// PermanentError wraps a publishing error that retrying won't fix (eg.
+	// storage rejecting the stats as malformed), so publishers that retry
+	// (eg. a spool) can give up on those stats rather than block behind them
+	PermanentError struct {
+		Err error
+	}
+
+	// Pool bounds how a publisher is run. Workers publish concurrently and
+	// up to Queue message sets wait for a worker; past that, Publish drops the
+	// set for that publisher and reports QueueFull. OnError, if set, is
+	// called with each error the publisher returns.
+	//
+	// When BatchSize or BatchInterval is set, a batch publisher's message
+	// sets are merged (their tags moving onto each message) and handed over
+	// once BatchSize messages have gathered or BatchInterval has passed. The
+	// batch gathering at Close is published unless DiscardOnClose is set.
+	Pool struct {
+		Workers int
+		Queue   int
+		OnError func(name string, err error)
+
+		BatchSize      int
+		BatchInterval  time.Duration
+		DiscardOnClose bool
+	}
+
+	// PublisherStats counts what happened to what was given to a publisher.
+	// Batch publishers count message sets, single publishers count messages.
+	PublisherStats struct {
+		Published int64  `json:"published"`
+		Failed    int64  `json:"failed"`
+		Dropped   int64  `json:"dropped"`
+		Queued    int    `json:"queued"`
+		LastError string `json:"last_error,omitempty"`
+	}
+
+	// publisher runs a batch or single publisher on its own pool
+	publisher struct {
+		name   string
+		pool   Pool
+		single bool // counts messages rather than message sets
+		send   func(MessageSet) []error
+
+		mu      sync.Mutex
+		stats   PublisherStats
+		jobs    chan MessageSet
+		pending MessageSet // the batch gathering
+		closed  bool
+		done    chan struct{} // closed when stopped, ends the batch timer
+		wg      sync.WaitGroup
+	}
+)
+
+// newPublisher starts the pool's workers, zero values use DefaultPool's
+func newPublisher(name string, pool Pool, single bool, send func(MessageSet) []error) *publisher {
+	if pool.Workers <= 0 {
+		pool.Workers = DefaultPool.Workers
+	}
+	if pool.Queue <= 0 {
+		pool.Queue = DefaultPool.Queue
+	}
+
+	p := &publisher{
+		name:   name,
+		pool:   pool,
+		single: single,
+		send:   send,
+		jobs:   make(chan MessageSet, pool.Queue),
+		done:   make(chan struct{}),
+	}
+
+	if p.batching() {
+		if p.pool.BatchInterval <= 0 {
+			p.pool.BatchInterval = DefaultBatchInterval
+		}
+		go p.tick()
+	}
+
+	p.wg.Add(pool.Workers)
+	for i := 0; i < pool.Workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// work publishes queued message sets until the publisher is stopped
+func (p *publisher) work() {
+	defer p.wg.Done()
+	for messages := range p.jobs {
+		errs := p.send(messages)
+
+		p.mu.Lock()
+		p.stats.Published += p.units(messages) - int64(len(errs))
+		p.stats.Failed += int64(len(errs))
+		if len(errs) > 0 {
+			p.stats.LastError = errs[len(errs)-1].Error()
+		}
+		p.mu.Unlock()
+
+		for _, err := range errs {
+			lumber.Trace("[PULSE :: PLEXER] %s failed to publish - %s", p.name, err)
+			if p.pool.OnError != nil {
+				p.pool.OnError(p.name, err)
+			}
+		}
+	}
+}
+
+// units is how many of the publisher's stats a message set counts for
+func (p *publisher) units(messages MessageSet) int64 {
+	if p.single {
+		return int64(len(messages.Messages))
+	}
+	return 1
+}
+
+// batching reports whether the publisher gathers batches
+func (p *publisher) batching() bool {
+	return !p.single && (p.pool.BatchSize > 0 || p.pool.BatchInterval > 0)
+}
+
+// tick hands over the gathering batch every BatchInterval
+func (p *publisher) tick() {
+	tick := time.NewTicker(p.pool.BatchInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			p.mu.Lock()
+			if !p.closed {
+				if err := p.flush(); err != nil {
+					lumber.Debug("[PULSE :: PLEXER] %s dropped a batch - %s", p.name, err)
+				}
+			}
+			p.mu.Unlock()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// enqueue hands the message set to a worker, or adds it to the gathering
+// batch, without blocking
+func (p *publisher) enqueue(messages MessageSet) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return PublisherStopped
+	}
+
+	if p.batching() {
+		for _, message := range messages.Messages {
+			message.Tags = append(append([]string{}, messages.Tags...), message.Tags...)
+			p.pending.Messages = append(p.pending.Messages, message)
+		}
+		if p.pool.BatchSize > 0 && len(p.pending.Messages) >= p.pool.BatchSize {
+			return p.flush()
+		}
+		return nil
+	}
+	return p.queue(messages)
+}
+
+// flush queues the gathering batch, the caller must hold the lock
+func (p *publisher) flush() error {
+	if len(p.pending.Messages) == 0 {
+		return nil
+	}
+	batch := p.pending
+	p.pending = MessageSet{}
+	return p.queue(batch)
+}
+
+// queue hands the message set to a worker without blocking, the caller must
+// hold the lock
+func (p *publisher) queue(messages MessageSet) error {
+	select {
+	case p.jobs <- messages:
+		return nil
+	default:
+		p.stats.Dropped += p.units(messages)
+		return QueueFull
+	}
+}
+
+// stop lets the workers finish what's queued, and the gathering batch unless
+// it's to be discarded, and waits for them
+func (p *publisher) stop() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.wg.Wait()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	batch := p.pending
+	p.pending = MessageSet{}
+	p.mu.Unlock()
+
+	if len(batch.Messages) > 0 {
+		if p.pool.DiscardOnClose {
+			p.mu.Lock()
+			p.stats.Dropped += p.units(batch)
+			p.mu.Unlock()
+		} else {
+			// wait for room, the workers are still draining the queue
+			p.jobs <- batch
+		}
+	}
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// snapshot returns the publisher's stats so far
+func (p *publisher) snapshot() PublisherStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Queued = len(p.jobs)
+	return stats
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent marks an error as one retrying won't fix
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return PermanentError{Err: err}
+}
+
+// IsPermanent reports whether retrying won't fix the error
+func IsPermanent(err error) bool {
+	_, ok := err.(PermanentError)
+	return ok
+}
@@ -0,0 +1,128 @@
+package plexer
+
+import (
+	"errors"
+	"path"
+	"sort"
+)
+
+var (
+	BadRoute = errors.New("Routes need a publisher and valid globs")
+)
+
+type (
+	// Route decides which messages a publisher gets. A message matches when
+	// its ID matches any of IDs and every one of Tags matches one of its tags
+	// (the message's or its set's); empty lists match anything. A publisher
+	// with routes gets the messages matching any route that keeps, unless a
+	// route that drops matches too. A publisher with only dropping routes gets
+	// everything else, one without routes gets everything.
+	Route struct {
+		Publisher string   `mapstructure:"publisher" json:"publisher"`
+		IDs       []string `mapstructure:"ids" json:"ids,omitempty"`
+		Tags      []string `mapstructure:"tags" json:"tags,omitempty"`
+		Drop      bool     `mapstructure:"drop" json:"drop,omitempty"`
+	}
+)
+
+// SetRoutes replaces the plexer's routes
+func (plex *Plexer) SetRoutes(routes []Route) error {
+	byPublisher := map[string][]Route{}
+	for _, route := range routes {
+		if route.Publisher == "" {
+			return BadRoute
+		}
+		for _, glob := range append(append([]string{}, route.IDs...), route.Tags...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return BadRoute
+			}
+		}
+		byPublisher[route.Publisher] = append(byPublisher[route.Publisher], route)
+	}
+
+	plex.lock.Lock()
+	plex.routes = byPublisher
+	plex.lock.Unlock()
+	return nil
+}
+
+// UnknownRoutes returns the publishers routes were set for that aren't
+// registered (eg. a typo), whatever those routes match goes nowhere
+func (plex *Plexer) UnknownRoutes() []string {
+	plex.lock.RLock()
+	defer plex.lock.RUnlock()
+
+	unknown := []string{}
+	for name := range plex.routes {
+		if plex.batch[name] == nil && plex.single[name] == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// matches reports whether the route applies to a message of the set
+func (route Route) matches(message Message, setTags []string) bool {
+	if len(route.IDs) > 0 && !anyMatch(route.IDs, message.ID) {
+		return false
+	}
+	for _, glob := range route.Tags {
+		found := false
+		for _, tag := range append(append([]string{}, message.Tags...), setTags...) {
+			if ok, _ := path.Match(glob, tag); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// anyMatch reports whether any of the globs match the name
+func anyMatch(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the messages of the set the routes let through, the set
+// itself if they all are
+func route(routes []Route, messages MessageSet) MessageSet {
+	if len(routes) == 0 {
+		return messages
+	}
+
+	keeping := false
+	for _, r := range routes {
+		keeping = keeping || !r.Drop
+	}
+
+	routed := MessageSet{Tags: messages.Tags, Messages: make([]Message, 0, len(messages.Messages))}
+	for _, message := range messages.Messages {
+		kept, dropped := !keeping, false
+		for _, r := range routes {
+			if !r.matches(message, messages.Tags) {
+				continue
+			}
+			if r.Drop {
+				dropped = true
+				break
+			}
+			kept = true
+		}
+		if kept && !dropped {
+			routed.Messages = append(routed.Messages, message)
+		}
+	}
+	if len(routed.Messages) == len(messages.Messages) {
+		return messages
+	}
+	return routed
+}
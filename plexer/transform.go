@@ -0,0 +1,245 @@
+package plexer
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	BadTransform = errors.New("Transforms need a known action, a valid regex and a target or factor where used")
+)
+
+type (
+	// Transform rewrites messages before they're published, much like a
+	// Prometheus relabel config. Source is what Regex is matched against:
+	// "id" (the default) or a tag's key, whose value is then used. Regex is
+	// anchored at both ends and defaults to "(.*)".
+	//
+	// Actions:
+	//  replace  sets Target ("id" or a tag key) to Replacement (default "$1"),
+	//           expanding $1 and the like, when the source matches. A tag
+	//           replaced with nothing is removed
+	//  keep     drops messages whose source doesn't match
+	//  drop     drops messages whose source matches
+	//  tagdrop  removes tags whose key matches
+	//  tagkeep  removes tags whose key doesn't match
+	//  scale    multiplies the value by Factor when the source matches (eg. bytes to MB)
+	Transform struct {
+		Action      string  `mapstructure:"action" json:"action"`
+		Source      string  `mapstructure:"source" json:"source,omitempty"`
+		Regex       string  `mapstructure:"regex" json:"regex,omitempty"`
+		Target      string  `mapstructure:"target" json:"target,omitempty"`
+		Replacement string  `mapstructure:"replacement" json:"replacement,omitempty"`
+		Factor      float64 `mapstructure:"factor" json:"factor,omitempty"`
+
+		regex *regexp.Regexp
+	}
+)
+
+// SetTransforms replaces the transforms applied, in order, to every message
+// set before it is routed to the publishers
+func (plex *Plexer) SetTransforms(transforms []Transform) error {
+	compiled := make([]Transform, 0, len(transforms))
+	for _, t := range transforms {
+		if t.Action == "" {
+			t.Action = "replace"
+		}
+		if t.Source == "" {
+			t.Source = "id"
+		}
+		if t.Regex == "" {
+			t.Regex = "(.*)"
+		}
+		if t.Replacement == "" {
+			t.Replacement = "$1"
+		}
+
+		var err error
+		t.regex, err = regexp.Compile("^(?:" + t.Regex + ")$")
+		if err != nil {
+			return BadTransform
+		}
+
+		switch t.Action {
+		case "replace":
+			if t.Target == "" {
+				return BadTransform
+			}
+		case "scale":
+			if t.Factor == 0 {
+				return BadTransform
+			}
+		case "keep", "drop", "tagdrop", "tagkeep":
+		default:
+			return BadTransform
+		}
+		compiled = append(compiled, t)
+	}
+
+	plex.lock.Lock()
+	plex.transforms = compiled
+	plex.lock.Unlock()
+	return nil
+}
+
+// transform applies the transforms to a copy of the message set
+func transform(transforms []Transform, messages MessageSet) MessageSet {
+	if len(transforms) == 0 {
+		return messages
+	}
+
+	transformed := MessageSet{Tags: messages.Tags, Messages: make([]Message, 0, len(messages.Messages))}
+	for _, t := range transforms {
+		if t.Action == "tagdrop" || t.Action == "tagkeep" {
+			transformed.Tags = t.filterTags(transformed.Tags)
+		}
+	}
+
+	// set tags that are replaced may be replaced differently per message, so
+	// they move onto each message rather than lingering beside the new value
+	pushed := []string{}
+	for _, t := range transforms {
+		if t.Action != "replace" || t.Target == "id" {
+			continue
+		}
+		kept := make([]string, 0, len(transformed.Tags))
+		for _, tag := range transformed.Tags {
+			if strings.HasPrefix(tag, t.Target+":") {
+				pushed = append(pushed, tag)
+			} else {
+				kept = append(kept, tag)
+			}
+		}
+		transformed.Tags = kept
+	}
+
+messages:
+	for _, message := range messages.Messages {
+		message.Tags = append([]string{}, message.Tags...)
+		for _, tag := range pushed {
+			// message tags take precedence over the set's
+			if !hasKey(message.Tags, strings.SplitN(tag, ":", 2)[0]) {
+				message.Tags = append(message.Tags, tag)
+			}
+		}
+		// later transforms only see the set tags earlier ones left
+		setTags := messages.Tags
+		for _, t := range transforms {
+			source, ok := t.source(message, setTags)
+			matched := ok && t.regex.MatchString(source)
+
+			switch t.Action {
+			case "keep":
+				if !matched {
+					continue messages
+				}
+			case "drop":
+				if matched {
+					continue messages
+				}
+			case "tagdrop", "tagkeep":
+				message.Tags = t.filterTags(message.Tags)
+				setTags = t.filterTags(setTags)
+			case "scale":
+				if matched {
+					message = t.scale(message)
+				}
+			case "replace":
+				if matched {
+					value := t.regex.ReplaceAllString(source, t.Replacement)
+					message = t.replace(message, value)
+				}
+			}
+		}
+		transformed.Messages = append(transformed.Messages, message)
+	}
+	return transformed
+}
+
+// source returns what the transform matches against, message tags taking
+// precedence over the set's
+func (t Transform) source(message Message, setTags []string) (string, bool) {
+	if t.Source == "id" {
+		return message.ID, true
+	}
+	for _, tags := range [][]string{message.Tags, setTags} {
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, t.Source+":") {
+				return strings.TrimPrefix(tag, t.Source+":"), true
+			}
+		}
+	}
+	return "", false
+}
+
+// hasKey reports whether any of the tags has the key
+func hasKey(tags []string, key string) bool {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, key+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTags returns the tags tagdrop or tagkeep leave, bare tags are
+// matched as a whole
+func (t Transform) filterTags(tags []string) []string {
+	kept := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		key := strings.SplitN(tag, ":", 2)[0]
+		if t.regex.MatchString(key) == (t.Action == "tagkeep") {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// replace sets the transform's target to the value
+func (t Transform) replace(message Message, value string) Message {
+	if t.Target == "id" {
+		if value != "" {
+			message.ID = value
+		}
+		return message
+	}
+
+	tags := make([]string, 0, len(message.Tags)+1)
+	for _, tag := range message.Tags {
+		if !strings.HasPrefix(tag, t.Target+":") {
+			tags = append(tags, tag)
+		}
+	}
+	if value != "" {
+		tags = append(tags, t.Target+":"+value)
+	}
+	message.Tags = tags
+	return message
+}
+
+// scale multiplies a numeric value by the transform's factor, anything else
+// is left alone
+func (t Transform) scale(message Message) Message {
+	var value float64
+	switch v := message.Value.(type) {
+	case float64:
+		value = v
+	case int64:
+		value = float64(v)
+	case nil:
+		f, err := strconv.ParseFloat(message.Data, 64)
+		if err != nil {
+			return message
+		}
+		value = f
+	default:
+		return message
+	}
+
+	value *= t.Factor
+	message.Value = value
+	message.Data = strconv.FormatFloat(value, 'g', -1, 64)
+	return message
+}
@@ -1,20 +1,77 @@
 package relay
 
-import ()
+import (
+	"context"
+	"time"
+)
+
+// FieldSeparator splits a value's name from the field of it the value is,
+// so related values (eg. a sample's mean and max) are stored together
+const FieldSeparator = "#"
 
 type (
-	// Collector is a stat to be collected
+	// Collector is a stat to be collected. A value named "" is reported under
+	// the collector's name, and names starting with '_' are reported as a
+	// suffix of it (eg. "_max" from collector "latency" becomes "latency_max").
+	// Names may end in FieldSeparator and a field (eg. "#max"), the server
+	// stores those as that field of the name before it.
 	Collector interface {
 		Collect() map[string]float64
 	}
 
-	collectorHandle func() map[string]float64
+	// Snapshotter is a Collector whose Collect starts a new interval (eg.
+	// Summary). Relay.Info uses Snapshot so inspecting the relay doesn't take
+	// values from the next poll.
+	Snapshotter interface {
+		Collector
+		Snapshot() map[string]float64
+	}
+
+	// ErrCollector is a Collector that can report a failed collection rather
+	// than faking a value. The context is cancelled once the collector's
+	// deadline passes.
+	ErrCollector interface {
+		Collector
+		CollectErr(ctx context.Context) (map[string]float64, error)
+	}
+
+	// ValueCollector is a Collector whose values may be integers, booleans or
+	// short strings (eg. a version or state) as well as floats. The relay uses
+	// CollectValues, carrying each value's type through to the publishers.
+	ValueCollector interface {
+		Collector
+		CollectValues(ctx context.Context) (map[string]interface{}, error)
+	}
+
+	// Intervaler is a Collector that gathers on its own schedule (eg.
+	// Sampled), which the server may change with 'set {collector} interval'.
+	Intervaler interface {
+		Collector
+		SetInterval(interval time.Duration)
+	}
+
+	collectorHandle    func() map[string]float64
+	errCollectorHandle func(context.Context) (map[string]float64, error)
+	valueHandle        func(context.Context) (map[string]interface{}, error)
 )
 
 func (c collectorHandle) Collect() map[string]float64 {
 	return c()
 }
 
+// Collect drops the values of a failed collection
+func (c errCollectorHandle) Collect() map[string]float64 {
+	values, err := c(context.Background())
+	if err != nil {
+		return map[string]float64{}
+	}
+	return values
+}
+
+func (c errCollectorHandle) CollectErr(ctx context.Context) (map[string]float64, error) {
+	return c(ctx)
+}
+
 func NewPointCollector(pf func() float64) Collector {
 	return collectorHandle(func() map[string]float64 {
 		return map[string]float64{"": pf()}
@@ -24,3 +81,45 @@ func NewPointCollector(pf func() float64) Collector {
 func NewSetCollector(sf collectorHandle) Collector {
 	return sf
 }
+
+// NewErrPointCollector creates a collector for a single value that may fail
+func NewErrPointCollector(pf func(context.Context) (float64, error)) ErrCollector {
+	return errCollectorHandle(func(ctx context.Context) (map[string]float64, error) {
+		value, err := pf(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]float64{"": value}, nil
+	})
+}
+
+// NewErrSetCollector creates a collector for a set of values that may fail
+func NewErrSetCollector(sf func(context.Context) (map[string]float64, error)) ErrCollector {
+	return errCollectorHandle(sf)
+}
+
+// Collect drops the values of a failed collection and those that aren't numbers
+func (c valueHandle) Collect() map[string]float64 {
+	values, err := c(context.Background())
+	if err != nil {
+		return map[string]float64{}
+	}
+	floats := make(map[string]float64, len(values))
+	for name, value := range values {
+		if f, ok := floatValue(value); ok {
+			floats[name] = f
+		}
+	}
+	return floats
+}
+
+func (c valueHandle) CollectValues(ctx context.Context) (map[string]interface{}, error) {
+	return c(ctx)
+}
+
+// NewValueCollector creates a collector for a set of typed values that may
+// fail. Values may be any int, uint, float, bool or string type, strings are
+// cut to MaxStringValue bytes and values of any other type are dropped.
+func NewValueCollector(vf func(context.Context) (map[string]interface{}, error)) ValueCollector {
+	return valueHandle(vf)
+}
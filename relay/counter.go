@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Wraparound points of common counters, for use with NewCounterCollector
+const (
+	Wrap32 = float64(math.MaxUint32) + 1
+	Wrap64 = float64(math.MaxUint64) + 1
+)
+
+type (
+	// counterCollector reports how quickly monotonic counters are growing
+	counterCollector struct {
+		sf   func() map[string]float64
+		wrap float64
+
+		mu   sync.Mutex
+		last map[string]float64
+		at   time.Time
+	}
+)
+
+// NewCounterCollector creates a collector that reports the per second rate
+// of a monotonic counter (bytes sent, requests served...) rather than its
+// ever growing value. If the counter goes backwards it is treated as having
+// wrapped at `wrap` (eg. Wrap32), or as having been reset when wrap is 0 or
+// the rollover is implausible. Nothing is reported until a second sample is
+// taken.
+func NewCounterCollector(cf func() float64, wrap float64) Collector {
+	return NewCounterSetCollector(func() map[string]float64 {
+		return map[string]float64{"": cf()}
+	}, wrap)
+}
+
+// NewCounterSetCollector is a NewCounterCollector for a set of counters
+func NewCounterSetCollector(sf func() map[string]float64, wrap float64) Collector {
+	return &counterCollector{sf: sf, wrap: wrap}
+}
+
+func (c *counterCollector) Collect() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	current := c.sf()
+	elapsed := now.Sub(c.at).Seconds()
+
+	rates := make(map[string]float64, len(current))
+	if c.last != nil && elapsed > 0 {
+		for name, value := range current {
+			prev, ok := c.last[name]
+			if !ok {
+				// new counter, wait for a second sample
+				continue
+			}
+			rates[name] = c.delta(prev, value) / elapsed
+		}
+	}
+
+	c.last = current
+	c.at = now
+	return rates
+}
+
+// delta returns how much the counter grew between samples
+func (c *counterCollector) delta(prev, current float64) float64 {
+	if current >= prev {
+		return current - prev
+	}
+
+	// the counter went backwards, it either rolled over or was reset. a
+	// rollover that covers more than half the counter's range is more likely
+	// a reset (restart) that landed on a small value.
+	if c.wrap > 0 {
+		wrapped := c.wrap - prev + current
+		if wrapped <= c.wrap/2 {
+			return wrapped
+		}
+	}
+	return current
+}
@@ -0,0 +1,261 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+type (
+	// LogCollector tails a log file, counting the lines matching each of its
+	// patterns between polls. A pattern with a `(?P<value>...)` group also
+	// summarizes the numbers that group captures (eg. response times).
+	LogCollector struct {
+		path     string
+		patterns map[string]*regexp.Regexp
+
+		mu        sync.Mutex
+		closed    bool
+		file      *os.File
+		reader    *bufio.Reader
+		offset    int64
+		partial   string // an unfinished last line
+		counts    map[string]int
+		summaries map[string]*Summary
+	}
+)
+
+// NewLogCollector creates a collector tailing the log at path from its
+// current end. patterns maps value names to the regular expressions whose
+// matching lines they count, eg.
+//
+//	relay.NewLogCollector("/var/log/nginx/access.log", map[string]string{
+//		"errors":   `" 5\d\d `,
+//		"upstream": `upstream_time=(?P<value>[\d.]+)`,
+//	})
+//
+// reports "errors" and "upstream" line counts along with "upstream_sum",
+// "upstream_min", "upstream_max" and percentiles of the captured times. The
+// file is reopened when it is rotated or truncated; the log doesn't need to
+// exist yet.
+func NewLogCollector(path string, patterns map[string]string) (*LogCollector, error) {
+	l := &LogCollector{
+		path:      path,
+		patterns:  make(map[string]*regexp.Regexp, len(patterns)),
+		counts:    make(map[string]int, len(patterns)),
+		summaries: make(map[string]*Summary),
+	}
+
+	for name, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		l.patterns[name] = re
+		for _, group := range re.SubexpNames() {
+			if group == "value" {
+				l.summaries[name] = NewSummaryCollector()
+			}
+		}
+	}
+
+	// only count what's logged from now on
+	if err := l.open(); err == nil {
+		l.offset, err = l.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			l.file.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// open opens the log from the start, the caller must hold the lock
+func (l *LogCollector) open() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.reader = bufio.NewReader(file)
+	l.offset = 0
+	l.partial = ""
+	return nil
+}
+
+// read counts the lines logged since the last read, following rotation and
+// truncation. The caller must hold the lock.
+func (l *LogCollector) read() error {
+	if l.closed {
+		return nil
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			if os.IsNotExist(err) {
+				// not logged to yet
+				return nil
+			}
+			return err
+		}
+	}
+
+	// a truncated log starts over
+	if info, err := l.file.Stat(); err == nil && info.Size() < l.offset {
+		if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		l.reader.Reset(l.file)
+		l.offset = 0
+		l.partial = ""
+	}
+
+	if err := l.readLines(); err != nil {
+		return err
+	}
+
+	// once the rotated log is drained, move on to the new one
+	current, err := os.Stat(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// rotated, but not recreated yet
+			return nil
+		}
+		return err
+	}
+	opened, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if os.SameFile(current, opened) {
+		return nil
+	}
+
+	l.file.Close()
+	l.file = nil
+	if err := l.open(); err != nil {
+		return err
+	}
+	return l.readLines()
+}
+
+// readLines counts lines up to the end of the file, the caller must hold the
+// lock
+func (l *LogCollector) readLines() error {
+	for {
+		line, err := l.reader.ReadString('\n')
+		l.offset += int64(len(line))
+		if err == io.EOF {
+			// wait for the rest of the line
+			l.partial += line
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		l.match(l.partial + line)
+		l.partial = ""
+	}
+}
+
+// match counts the line against each pattern, the caller must hold the lock
+func (l *LogCollector) match(line string) {
+	for name, re := range l.patterns {
+		submatches := re.FindStringSubmatch(line)
+		if submatches == nil {
+			continue
+		}
+		l.counts[name]++
+
+		summary, ok := l.summaries[name]
+		if !ok {
+			continue
+		}
+		for i, group := range re.SubexpNames() {
+			if group != "value" {
+				continue
+			}
+			if value, err := strconv.ParseFloat(submatches[i], 64); err == nil {
+				summary.Observe(value)
+			}
+		}
+	}
+}
+
+// values reports the counts and summaries, the caller must hold the lock
+func (l *LogCollector) values(reset bool) map[string]float64 {
+	values := make(map[string]float64, len(l.patterns))
+	for name := range l.patterns {
+		values[name] = float64(l.counts[name])
+		if reset {
+			l.counts[name] = 0
+		}
+	}
+
+	for name, summary := range l.summaries {
+		var summarized map[string]float64
+		if reset {
+			summarized = summary.Collect()
+		} else {
+			summarized = summary.Snapshot()
+		}
+		for stat, value := range summarized {
+			// the line count already covers it
+			if stat == "_count" {
+				continue
+			}
+			values[name+stat] = value
+		}
+	}
+	return values
+}
+
+// Collect drops the values of a failed read
+func (l *LogCollector) Collect() map[string]float64 {
+	values, err := l.CollectErr(context.Background())
+	if err != nil {
+		return map[string]float64{}
+	}
+	return values
+}
+
+// CollectErr reports what was logged since the last collection and starts a
+// new interval
+func (l *LogCollector) CollectErr(ctx context.Context) (map[string]float64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.read(); err != nil {
+		return nil, err
+	}
+	return l.values(true), nil
+}
+
+// Snapshot reports what was logged since the last collection without
+// starting a new interval
+func (l *LogCollector) Snapshot() map[string]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.read()
+	return l.values(false)
+}
+
+// Close stops tailing the log
+func (l *LogCollector) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -3,11 +3,14 @@
 package relay
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	// when implementing relay, set `lumber.Level(lumber.LvlInt("TRACE"))` in client to view logs
@@ -16,31 +19,245 @@ import (
 
 var (
 	UnableToIdentify   = errors.New("unable to identify with pulse")
-	ReservedName       = errors.New("cannot use - or : or , or _connected in your name")
+	ReservedName       = errors.New("cannot use - or : or , or _connected, _stalled, _timeouts, _errors in your name")
 	DuplicateCollector = errors.New("cannot add a duplicate collector to the set")
-	beatInterval       = 30
+	UnknownCollector   = errors.New("no collector by that name")
+	NoServers          = errors.New("no pulse servers to connect to")
+	CollectTimedOut    = errors.New("collection timed out")
+	CollectStalled     = errors.New("previous collection still running")
+	RelayClosed        = errors.New("relay is closed")
+	NoInterval         = errors.New("collector doesn't gather on an interval")
+	BadCommand         = errors.New("malformed command")
+	beatInterval       = 30 // until the server says otherwise
+
+	// names Info uses to report the relay's own health
+	reservedNames = map[string]bool{"_connected": true, "_stalled": true, "_timeouts": true, "_errors": true}
+
+	// CollectTimeout is how long a collector may run before it is reported
+	// missing. It can be overridden per collector with SetCollectTimeout.
+	CollectTimeout = 10 * time.Second
+
+	// FailbackInterval is how often a relay connected to a backup server
+	// checks whether its primary server is back
+	FailbackInterval = time.Minute
 )
 
 type (
 	// Relay is a pulse client
 	Relay struct {
-		conn       net.Conn
-		dataChan   chan string
-		errChan    chan error
-		collectors map[string]taggedCollector
+		conn       *connection
+		connLock   sync.Mutex
+		collectors map[string]*taggedCollector
+		lock       sync.RWMutex // guards collectors and beatInterval
 		connected  bool
-		hostAddr   string
+		servers    []string // configured servers, in order of preference
+		hostAddr   string   // server currently connected to
+		primary    bool     // whether hostAddr is the preferred server
 		myId       string
+
+		beatInterval int // heartbeat frequency (seconds), set by the server
+
+		ctx       context.Context
+		cancel    context.CancelFunc
+		wg        sync.WaitGroup // tracks the relay's goroutines
+		done      chan struct{}  // closed once the relay has fully stopped
+		closeOnce sync.Once
+		closeErr  error
+	}
+
+	// connection is a single connection to a server and what its reader reads
+	connection struct {
+		net.Conn
+		data chan string
+		errs chan error
+
+		closed    chan struct{} // closed when the connection is abandoned
+		closeOnce sync.Once
 	}
 
 	// stores the collector and its associated tags
 	taggedCollector struct {
 		collector Collector
-		tags      []string
+		timeout   time.Duration
+
+		mu       sync.Mutex
+		tags     []string
+		disabled bool      // the server asked us not to collect it
+		running  bool      // a Collect call is in flight
+		started  time.Time // when the in flight Collect began
+		timeouts int       // number of collections that missed their deadline
+		errors   int       // number of collections that returned an error
 	}
 )
 
-func (relay *Relay) readData() {
+// deadline returns how long the collector may run
+func (tc *taggedCollector) deadline() time.Duration {
+	if tc.timeout > 0 {
+		return tc.timeout
+	}
+	return CollectTimeout
+}
+
+// collect runs the collector in its own goroutine and waits at most its
+// deadline for the values. A collector that is still running from an earlier
+// call is not started again, it is simply reported as stalled.
+func (tc *taggedCollector) collect(ctx context.Context) (map[string]interface{}, error) {
+	tc.mu.Lock()
+	if tc.running {
+		tc.mu.Unlock()
+		return nil, CollectStalled
+	}
+	tc.running = true
+	tc.started = time.Now()
+	timeout := tc.deadline()
+	tc.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		values map[string]interface{}
+		err    error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		switch collector := tc.collector.(type) {
+		case ValueCollector:
+			r.values, r.err = collector.CollectValues(ctx)
+		case ErrCollector:
+			var values map[string]float64
+			values, r.err = collector.CollectErr(ctx)
+			r.values = typedValues(values)
+		default:
+			r.values = typedValues(collector.Collect())
+		}
+		tc.mu.Lock()
+		tc.running = false
+		if r.err != nil {
+			tc.errors++
+		}
+		tc.mu.Unlock()
+		done <- r
+	}()
+
+	select {
+	case r := <-done:
+		return r.values, r.err
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			// the relay is closing
+			return nil, ctx.Err()
+		}
+		tc.mu.Lock()
+		tc.timeouts++
+		tc.mu.Unlock()
+		return nil, CollectTimedOut
+	}
+}
+
+// health reports whether the collector is still running past its deadline
+// along with how many of its collections have timed out or failed.
+func (tc *taggedCollector) health() (stalled bool, timeouts, errors int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.running && time.Since(tc.started) > tc.deadline(), tc.timeouts, tc.errors
+}
+
+// tagList returns the collector's current tags
+func (tc *taggedCollector) tagList() []string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.tags
+}
+
+// enabled reports whether the server wants the collector collected
+func (tc *taggedCollector) enabled() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return !tc.disabled
+}
+
+// gather runs the given collectors concurrently and returns the values of
+// those that succeeded in time along with the errors of those that didn't,
+// both keyed by collector name.
+func gather(ctx context.Context, collectors map[string]*taggedCollector) (map[string]map[string]interface{}, map[string]error) {
+	type result struct {
+		name   string
+		values map[string]interface{}
+		err    error
+	}
+
+	results := make(chan result, len(collectors))
+	for name, tc := range collectors {
+		go func(name string, tc *taggedCollector) {
+			values, err := tc.collect(ctx)
+			if err != nil {
+				lumber.Trace("[PULSE :: RELAY] stat %s failed - %s", name, err)
+			}
+			results <- result{name, values, err}
+		}(name, tc)
+	}
+
+	collected := make(map[string]map[string]interface{}, len(collectors))
+	failed := make(map[string]error)
+	for range collectors {
+		r := <-results
+		if r.err != nil {
+			failed[r.name] = r.err
+			continue
+		}
+		collected[r.name] = r.values
+	}
+
+	return collected, failed
+}
+
+// close abandons the connection, stopping its reader
+func (conn *connection) close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return conn.Conn.Close()
+}
+
+// current returns the connection in use
+func (relay *Relay) current() *connection {
+	relay.connLock.Lock()
+	defer relay.connLock.Unlock()
+	return relay.conn
+}
+
+// snapshot returns a copy of the relay's collectors, safe to range over
+// while collectors are added and removed
+func (relay *Relay) snapshot() map[string]*taggedCollector {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+
+	collectors := make(map[string]*taggedCollector, len(relay.collectors))
+	for name, tagCollector := range relay.collectors {
+		collectors[name] = tagCollector
+	}
+	return collectors
+}
+
+// beatFrequency returns how often to send heartbeats
+func (relay *Relay) beatFrequency() time.Duration {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+	return time.Duration(relay.beatInterval) * time.Second
+}
+
+// write sends a message on the connection in use
+func (relay *Relay) write(msg string) error {
+	_, err := relay.current().Write([]byte(msg))
+	return err
+}
+
+func (relay *Relay) readData(conn *connection) {
+	defer relay.wg.Done()
+
 	zero := time.Time{}
 	for {
 		// make a temporary bytes var to read from the connection
@@ -51,9 +268,10 @@ func (relay *Relay) readData() {
 		// loop through the connection stream, appending tmp to data
 		for {
 			// read to the tmp var
-			n, err := relay.conn.Read(tmp)
+			n, err := conn.Read(tmp)
 			if err != nil {
-				relay.errChan <- err
+				// errs is buffered so the reader never outlives its connection
+				conn.errs <- err
 				return
 			}
 
@@ -66,112 +284,276 @@ func (relay *Relay) readData() {
 			}
 		}
 
-		relay.conn.SetReadDeadline(zero)
+		conn.SetReadDeadline(zero)
 
 		// return strings.TrimSuffix(string(data), "\n"), nil
 		datas := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
 		for i := range datas {
-			relay.dataChan <- datas[i]
+			select {
+			case conn.data <- datas[i]:
+			case <-conn.closed:
+				return
+			}
 		}
 	}
 }
 
 // beat allows the detection and handling of stale tcp connections
 func (relay *Relay) beat() {
+	defer relay.wg.Done()
+
 	for {
-		time.Sleep(time.Duration(beatInterval) * time.Second)
+		frequency := relay.beatFrequency()
+		timer := time.NewTimer(frequency)
+		select {
+		case <-timer.C:
+		case <-relay.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		conn := relay.current()
 		// since we're always reading, lets set a timeout for the pong to come back in 1/2 beat time
-		relay.conn.SetReadDeadline(time.Now().Add(time.Duration(beatInterval/2) * time.Second))
+		conn.SetReadDeadline(time.Now().Add(frequency / 2))
 		lumber.Trace("[PULSE :: RELAY] PULSE pinging...")
-		_, err := relay.conn.Write([]byte("ping\n"))
+		_, err := conn.Write([]byte("ping\n"))
 		if err != nil {
 			lumber.Trace("[PULSE :: RELAY] PULSE ping failed - %s", err)
-			relay.errChan <- err
-			return
+			// the reader reports the broken connection, causing a reconnect
+			conn.close()
+			continue
 		}
 		lumber.Trace("[PULSE :: RELAY] PULSE pinged!")
 	}
 }
 
-// establishConnection establishes a connection and id's with the server
+// resolve returns the addresses of the configured servers in order of
+// preference. Servers without a port are looked up as DNS SRV names.
+func (relay *Relay) resolve() []string {
+	addrs := make([]string, 0, len(relay.servers))
+	for _, server := range relay.servers {
+		if _, _, err := net.SplitHostPort(server); err == nil {
+			addrs = append(addrs, server)
+			continue
+		}
+
+		// srv records come sorted by priority and randomized by weight
+		_, records, err := net.LookupSRV("", "", server)
+		if err != nil {
+			lumber.Debug("[PULSE :: RELAY] Failed to lookup SRV record %s - %s", server, err)
+			continue
+		}
+		for _, record := range records {
+			target := strings.TrimSuffix(record.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+		}
+	}
+	return addrs
+}
+
+// establishConnection connects to the most preferred server available
 func (relay *Relay) establishConnection() error {
-	conn, err := net.DialTimeout("tcp", relay.hostAddr, 10*time.Second)
+	addrs := relay.resolve()
+	if len(addrs) == 0 {
+		return NoServers
+	}
+
+	var err error
+	for i, addr := range addrs {
+		if err = relay.connect(addr); err == nil {
+			relay.primary = i == 0
+			if !relay.primary {
+				lumber.Info("[PULSE :: RELAY] Failed over to host %s", addr)
+			}
+			return nil
+		}
+		lumber.Debug("[PULSE :: RELAY] Failed to connect to host %s - %s", addr, err)
+	}
+	return err
+}
+
+// connect establishes a connection and id's with the server
+func (relay *Relay) connect(addr string) error {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	netConn, err := dialer.DialContext(relay.ctx, "tcp", addr)
 	if err != nil {
 		return err
 	}
 
+	conn := &connection{
+		Conn:   netConn,
+		data:   make(chan string),
+		errs:   make(chan error, 1),
+		closed: make(chan struct{}),
+	}
+
 	// send id
 	conn.Write([]byte(fmt.Sprintf("id %s\n", relay.myId)))
 
-	// hand over connection to client (relay)
+	// hand over connection to client (relay), unless the relay closed while
+	// dialing (shutdown closes whatever connection is current)
+	relay.connLock.Lock()
+	if relay.ctx.Err() != nil {
+		relay.connLock.Unlock()
+		conn.close()
+		return RelayClosed
+	}
 	relay.conn = conn
-
-	relay.dataChan = make(chan string)
-	relay.errChan = make(chan error)
+	relay.hostAddr = addr
+	relay.connLock.Unlock()
 
 	// start data reader
-	go relay.readData()
+	relay.wg.Add(1)
+	go relay.readData(conn)
 
 	var line string
 
 	select {
-	case line = <-relay.dataChan:
-	case err := <-relay.errChan:
+	case line = <-conn.data:
+	case err := <-conn.errs:
+		conn.close()
 		return err
+	case <-relay.ctx.Done():
+		conn.close()
+		return RelayClosed
 	}
 
 	if line != "ok" {
+		conn.close()
 		return UnableToIdentify
 	}
 
 	// add relay's known collectors
-	for name, value := range relay.collectors {
-		relay.conn.Write([]byte(fmt.Sprintf("add %s:%s\n", name, strings.Join(value.tags, ","))))
+	for name, value := range relay.snapshot() {
+		conn.Write([]byte(fmt.Sprintf("add %s:%s\n", name, strings.Join(value.tagList(), ","))))
 	}
 
 	return nil
 }
 
-// NewRelay creates a new client (relay)
+// failback reconnects to the primary server if it's back. It only checks that
+// the server is reachable, the reconnect then starts with the primary.
+func (relay *Relay) failback() {
+	addrs := relay.resolve()
+	if len(addrs) == 0 || addrs[0] == relay.hostAddr {
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", addrs[0], 2*time.Second)
+	if err != nil {
+		return
+	}
+	conn.Close()
+
+	lumber.Info("[PULSE :: RELAY] Host %s is back, failing back...", addrs[0])
+	// the reader reports the closed connection, causing a reconnect
+	relay.current().close()
+}
+
+// NewRelay creates a new client (relay). The address may be a comma separated
+// list of servers in order of preference; the relay fails over to the next
+// server when one is down and returns to the first when it recovers. A server
+// without a port is looked up as a DNS SRV name (eg. "_pulse._tcp.example.com").
 func NewRelay(address, id string) (*Relay, error) {
+	return NewRelayContext(context.Background(), address, id)
+}
+
+// NewRelayContext creates a new client (relay) that stops, as if closed, when
+// ctx is done.
+func NewRelayContext(ctx context.Context, address, id string) (*Relay, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	newRelay := &Relay{
-		connected:  true,
-		collectors: make(map[string]taggedCollector, 0),
-		hostAddr:   address,
-		myId:       id,
+		connected:    true,
+		collectors:   make(map[string]*taggedCollector, 0),
+		servers:      strings.Split(address, ","),
+		myId:         id,
+		ctx:          ctx,
+		beatInterval: beatInterval,
+		cancel:       cancel,
+		done:         make(chan struct{}),
 	}
 	err := newRelay.establishConnection()
 	if err != nil {
+		cancel()
+		// shutdown isn't running yet to close what was connected
+		if conn := newRelay.current(); conn != nil {
+			conn.close()
+		}
+		newRelay.wg.Wait()
 		return nil, err
 	}
 
+	newRelay.wg.Add(2)
 	go newRelay.runLoop()
 
 	// start heartbeat
 	go newRelay.beat()
 
+	go newRelay.shutdown()
+
 	return newRelay, nil
 }
 
+// shutdown waits for the relay's context to end, then disconnects, waits for
+// the relay's goroutines to stop and stops any remaining collectors
+func (relay *Relay) shutdown() {
+	<-relay.ctx.Done()
+
+	relay.connLock.Lock()
+	relay.closeErr = relay.conn.close()
+	relay.connLock.Unlock()
+
+	relay.wg.Wait()
+
+	for _, tagCollector := range relay.snapshot() {
+		if closer, ok := tagCollector.collector.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	lumber.Trace("[PULSE :: RELAY] Closed")
+	close(relay.done)
+}
+
 // runLoop handles communication from the server
 func (relay *Relay) runLoop() {
+	defer relay.wg.Done()
+
+	failback := time.NewTicker(FailbackInterval)
+	defer failback.Stop()
+
 	for {
+		conn := relay.current()
 		select {
-		case err := <-relay.errChan:
-			lumber.Error("[PULSE :: RELAY] Disconnected from host %s!", relay.hostAddr)
-			relay.conn.Close()
-			// retry indefinitely
+		case <-relay.ctx.Done():
+			return
+		case err := <-conn.errs:
+			lumber.Error("[PULSE :: RELAY] Disconnected from host %s! - %s", relay.hostAddr, err)
+			conn.close()
+			// retry until reconnected or closed
 			for {
 				if err = relay.establishConnection(); err == nil {
 					lumber.Info("[PULSE :: RELAY] Reconnected to host %s!", relay.hostAddr)
 					break
 				}
-				lumber.Debug("[PULSE :: RELAY] Reconnecting to host %s...  Fail!", relay.hostAddr)
-				<-time.After(5 * time.Second)
+				if relay.ctx.Err() != nil {
+					return
+				}
+				lumber.Debug("[PULSE :: RELAY] Reconnecting to hosts %s...  Fail!", strings.Join(relay.servers, ","))
+				select {
+				case <-time.After(5 * time.Second):
+				case <-relay.ctx.Done():
+					return
+				}
 			}
 			// we won't have anything in 'line' so continue
 			continue
-		case line := <-relay.dataChan:
+		case <-failback.C:
+			if !relay.primary {
+				relay.failback()
+			}
+			continue
+		case line := <-conn.data:
 			line = strings.TrimSuffix(line, "\n")
 			split := strings.SplitN(line, " ", 2)
 
@@ -189,7 +571,9 @@ func (relay *Relay) runLoop() {
 				}
 				num, err := strconv.Atoi(split[1])
 				if err == nil {
-					beatInterval = num
+					relay.lock.Lock()
+					relay.beatInterval = num
+					relay.lock.Unlock()
 				}
 			case "get":
 				if len(split) != 2 {
@@ -197,27 +581,33 @@ func (relay *Relay) runLoop() {
 				}
 				lumber.Trace("[PULSE :: RELAY] GET: %s", split)
 				stats := strings.Split(split[1], ",")
-				results := make([]string, 0)
+				collectors := make(map[string]*taggedCollector, len(stats))
+				relay.lock.RLock()
 				for _, stat := range stats {
 					tagCollector, ok := relay.collectors[stat]
 					if !ok {
 						lumber.Trace("[PULSE :: RELAY] stat %s !ok", stat)
 						continue
 					}
-					for name, value := range tagCollector.collector.Collect() {
-						formatted := strconv.FormatFloat(value, 'f', 4, 64)
-						if name == "" {
-							name = stat
-						}
-						results = append(results, fmt.Sprintf("%s-%s:%s", stat, name, formatted))
+					if !tagCollector.enabled() {
+						lumber.Trace("[PULSE :: RELAY] stat %s disabled", stat)
+						continue
 					}
+					collectors[stat] = tagCollector
 				}
-				if len(results) > 0 {
-					response := fmt.Sprintf("got %s\n", strings.Join(results, ","))
-					_, err := relay.conn.Write([]byte(response))
-					if err != nil {
-						lumber.Trace("[PULSE :: RELAY] GET response write error - %s", err)
-					}
+				relay.lock.RUnlock()
+				// collect off the loop so a slow collector can't hold up pings,
+				// reconnects or other requests
+				relay.wg.Add(1)
+				go relay.respond(conn, stats, collectors)
+			case "enable", "disable", "set":
+				lumber.Trace("[PULSE :: RELAY] CONFIG: %s", split)
+				response := fmt.Sprintf("ok %s\n", line)
+				if err := relay.configure(line); err != nil {
+					response = fmt.Sprintf("err %s:%s\n", line, err)
+				}
+				if _, err := conn.Write([]byte(response)); err != nil {
+					lumber.Trace("[PULSE :: RELAY] CONFIG response write error - %s", err)
 				}
 			default:
 				lumber.Trace("[PULSE :: RELAY] BAD: %s", split)
@@ -227,18 +617,158 @@ func (relay *Relay) runLoop() {
 	}
 }
 
+// configure applies a configuration command from the server:
+// 'enable {collector}', 'disable {collector}' or
+// 'set {collector} interval {seconds}'
+func (relay *Relay) configure(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return BadCommand
+	}
+
+	relay.lock.RLock()
+	tagCollector, ok := relay.collectors[fields[1]]
+	relay.lock.RUnlock()
+	if !ok {
+		return UnknownCollector
+	}
+
+	switch {
+	case fields[0] == "enable" && len(fields) == 2:
+		tagCollector.mu.Lock()
+		tagCollector.disabled = false
+		tagCollector.mu.Unlock()
+	case fields[0] == "disable" && len(fields) == 2:
+		tagCollector.mu.Lock()
+		tagCollector.disabled = true
+		tagCollector.mu.Unlock()
+	case fields[0] == "set" && len(fields) == 4 && fields[2] == "interval":
+		seconds, err := strconv.Atoi(fields[3])
+		if err != nil || seconds <= 0 {
+			return BadCommand
+		}
+		intervaler, ok := tagCollector.collector.(Intervaler)
+		if !ok {
+			return NoInterval
+		}
+		intervaler.SetInterval(time.Duration(seconds) * time.Second)
+	default:
+		return BadCommand
+	}
+	return nil
+}
+
+// statName names a collected value: a collector's unnamed value takes the
+// collector's name and names starting with '_' are suffixes of it
+func statName(stat, name string) string {
+	switch {
+	case name == "":
+		return stat
+	case strings.HasPrefix(name, "_"), strings.HasPrefix(name, FieldSeparator):
+		return stat + name
+	}
+	return name
+}
+
+// respond collects the requested stats and writes the 'got' response. Stats
+// whose collector failed or didn't finish in time are left out of the
+// response and reported with a 'fail' instead.
+func (relay *Relay) respond(conn net.Conn, stats []string, collectors map[string]*taggedCollector) {
+	defer relay.wg.Done()
+
+	collected, failed := gather(relay.ctx, collectors)
+
+	results := make([]string, 0)
+	for _, stat := range stats {
+		values, ok := collected[stat]
+		if !ok {
+			continue
+		}
+		// only report each stat once, even if requested twice
+		delete(collected, stat)
+		for name, value := range values {
+			normalized, ok := normalize(value)
+			if !ok {
+				lumber.Trace("[PULSE :: RELAY] stat %s has a value of unsupported type %T", stat, value)
+				continue
+			}
+			name = statName(stat, name)
+			if strings.HasPrefix(name, RuntimePrefix) && !isRuntime(collectors[stat].collector) {
+				// keep other collectors' values (eg. a scraped service's
+				// go_goroutines) out of the relay's own runtime series
+				name = stat + "_" + name
+			}
+			results = append(results, fmt.Sprintf("%s-%s:%s", stat, name, encodeValue(normalized)))
+		}
+	}
+
+	if len(results) > 0 {
+		response := fmt.Sprintf("got %s\n", strings.Join(results, ","))
+		_, err := conn.Write([]byte(response))
+		if err != nil {
+			lumber.Trace("[PULSE :: RELAY] GET response write error - %s", err)
+		}
+	}
+
+	for stat, err := range failed {
+		// the reason must stay on one line
+		reason := strings.Replace(err.Error(), "\n", " ", -1)
+		_, err := conn.Write([]byte(fmt.Sprintf("fail %s:%s\n", stat, reason)))
+		if err != nil {
+			lumber.Trace("[PULSE :: RELAY] GET fail write error - %s", err)
+		}
+	}
+}
+
+// Info returns the relay's current values along with its health. '_stalled'
+// counts collectors running past their deadline, '_timeouts' counts the
+// collections that have timed out and '_errors' those that failed.
 func (relay *Relay) Info() map[string]float64 {
-	stats := make(map[string]float64, 2)
+	stats := make(map[string]float64, 5)
 	stats["_connected"] = 0
 	if relay.connected {
 		stats["_connected"] = 1
 	}
-	for collection, stat := range relay.collectors {
-		values := stat.collector.Collect()
+
+	// collect first so this call's timeouts and failures are counted. values
+	// of snapshotters are peeked at so the next poll still gets them.
+	all := relay.snapshot()
+	collectors := make(map[string]*taggedCollector, len(all))
+	collected := make(map[string]map[string]interface{})
+	for collection, stat := range all {
+		if snapshotter, ok := stat.collector.(Snapshotter); ok {
+			collected[collection] = typedValues(snapshotter.Snapshot())
+			continue
+		}
+		collectors[collection] = stat
+	}
+	gathered, _ := gather(relay.ctx, collectors)
+	for collection, values := range gathered {
+		collected[collection] = values
+	}
+
+	stats["_stalled"] = 0
+	stats["_timeouts"] = 0
+	stats["_errors"] = 0
+	for collection, stat := range all {
+		stalled, timeouts, errors := stat.health()
+		if stalled {
+			stats["_stalled"]++
+			stats[collection+"-_stalled"] = 1
+		}
+		stats["_timeouts"] += float64(timeouts)
+		stats["_errors"] += float64(errors)
+	}
+	for collection, values := range collected {
 		for name, value := range values {
+			// only numbers (and booleans as 1 or 0) fit in Info
+			value, ok := floatValue(value)
+			if !ok {
+				continue
+			}
 			switch {
-			case name == "":
-				stats[collection] = value
+			case name == "" || strings.HasPrefix(name, "_"):
+				stats[statName(collection, name)] = value
 			default:
 				stats[collection+"-"+name] = value
 			}
@@ -250,42 +780,102 @@ func (relay *Relay) Info() map[string]float64 {
 // AddCollector adds a collector to relay
 func (relay *Relay) AddCollector(name string, tags []string, collector Collector) error {
 	// These characters are reserved in pulse and may not be used as part of an identifier.
-	if name == "_connected" || strings.ContainsAny(name, "-:,") {
+	if reservedNames[name] || strings.ContainsAny(name, "-:,") {
 		lumber.Trace("[PULSE :: RELAY] Reserved name!")
 		return ReservedName
 	}
+
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
 	if _, ok := relay.collectors[name]; ok {
 		lumber.Trace("[PULSE :: RELAY] Duplicate collector!")
 		return DuplicateCollector
 	}
-	if _, err := relay.conn.Write([]byte(fmt.Sprintf("add %s:%s\n", name, strings.Join(tags, ",")))); err != nil {
+	if err := relay.write(fmt.Sprintf("add %s:%s\n", name, strings.Join(tags, ","))); err != nil {
 		lumber.Trace("[PULSE :: RELAY] Failed to add collector to server - %s", err)
 		return err
 	}
 
 	// if successfully added collector, add it to relay's known collectors
-	// todo: lock
-	relay.collectors[name] = taggedCollector{collector: collector, tags: tags}
+	relay.collectors[name] = &taggedCollector{collector: collector, tags: tags}
 	lumber.Trace("[PULSE :: RELAY] Added '%s' as collector.", name)
 	return nil
 }
 
+// SetTags replaces the tags of the named collector without removing it, so
+// its stats are tagged differently from the next poll on (eg. flipping
+// 'role:primary' after a failover). The new tags are kept if the server
+// can't be reached and sent with the collector when the relay reconnects.
+func (relay *Relay) SetTags(name string, tags []string) error {
+	relay.lock.RLock()
+	defer relay.lock.RUnlock()
+
+	tagCollector, ok := relay.collectors[name]
+	if !ok {
+		return UnknownCollector
+	}
+	tagCollector.mu.Lock()
+	tagCollector.tags = append([]string{}, tags...)
+	tagCollector.mu.Unlock()
+
+	if err := relay.write(fmt.Sprintf("tag %s:%s\n", name, strings.Join(tags, ","))); err != nil {
+		lumber.Trace("[PULSE :: RELAY] Failed to retag collector on server - %s", err)
+		return err
+	}
+	lumber.Trace("[PULSE :: RELAY] Retagged '%s' with %s.", name, tags)
+	return nil
+}
+
+// SetCollectTimeout sets how long the named collector may run before it is
+// reported missing. A timeout of 0 uses CollectTimeout.
+func (relay *Relay) SetCollectTimeout(name string, timeout time.Duration) error {
+	relay.lock.RLock()
+	tagCollector, ok := relay.collectors[name]
+	relay.lock.RUnlock()
+	if !ok {
+		return UnknownCollector
+	}
+	tagCollector.mu.Lock()
+	tagCollector.timeout = timeout
+	tagCollector.mu.Unlock()
+	return nil
+}
+
 func (relay *Relay) RemoveCollector(name string) {
-	_, found := relay.collectors[name]
+	relay.lock.Lock()
+	tagCollector, found := relay.collectors[name]
+	delete(relay.collectors, name)
+	relay.lock.Unlock()
+
 	if found {
-		// todo: lock
-		delete(relay.collectors, name)
+		// stop collectors that do work in the background (eg. Sampled)
+		if closer, ok := tagCollector.collector.(io.Closer); ok {
+			closer.Close()
+		}
 		lumber.Trace("[PULSE :: RELAY] Removed '%s' as collector.", name)
-		if _, err := relay.conn.Write([]byte(fmt.Sprintf("remove %s\n", name))); err != nil {
+		if err := relay.write(fmt.Sprintf("remove %s\n", name)); err != nil {
 			lumber.Trace("[PULSE :: RELAY] Failed to remove collector from server - %s", err)
 		}
 	}
 }
 
+// Close removes the relay's collectors from the server, disconnects and
+// stops all of the relay's goroutines. It is safe to call more than once.
 func (relay *Relay) Close() error {
-	for name := range relay.collectors {
-		relay.RemoveCollector(name)
-	}
-	relay.conn.Write([]byte("close\n"))
-	return relay.conn.Close()
+	relay.closeOnce.Do(func() {
+		for name := range relay.snapshot() {
+			relay.RemoveCollector(name)
+		}
+		relay.write("close\n")
+		relay.cancel()
+	})
+	<-relay.done
+	return relay.closeErr
+}
+
+// Done returns a channel that's closed once the relay has stopped, either
+// from Close or because its context ended
+func (relay *Relay) Done() <-chan struct{} {
+	return relay.done
 }
@@ -1,12 +1,25 @@
 package relay_test
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/spf13/viper"
+
 	"github.com/nanopack/pulse/plexer"
 	"github.com/nanopack/pulse/relay"
 	"github.com/nanopack/pulse/server"
@@ -43,6 +56,9 @@ func stdoutPublisher(messages plexer.MessageSet) error {
 }
 
 func TestMain(m *testing.M) {
+	// server read deadlines are based on the beat interval
+	viper.SetDefault("beat-interval", 30)
+
 	go server.StartPolling(nil, nil, 1*time.Second, nil)
 
 	err := server.Listen(serverAddr, stdoutPublisher)
@@ -104,3 +120,493 @@ func TestCollectors(t *testing.T) {
 
 	testRelay.Close()
 }
+
+func TestSlowCollector(t *testing.T) {
+	slowRelay, err := relay.NewRelay(serverAddr, "slow_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer slowRelay.Close()
+
+	hang := make(chan struct{})
+	defer close(hang)
+
+	slowCollector := relay.NewPointCollector(func() float64 {
+		<-hang
+		return 1.0
+	})
+	fastCollector := relay.NewPointCollector(func() float64 {
+		return 2.0
+	})
+
+	if err := slowRelay.AddCollector("slow", nil, slowCollector); err != nil {
+		t.Errorf("Failed to add slow collector - %s\n", err)
+		t.FailNow()
+	}
+	if err := slowRelay.AddCollector("fast", nil, fastCollector); err != nil {
+		t.Errorf("Failed to add fast collector - %s\n", err)
+		t.FailNow()
+	}
+	if err := slowRelay.SetCollectTimeout("slow", 100*time.Millisecond); err != nil {
+		t.Errorf("Failed to set collect timeout - %s\n", err)
+		t.FailNow()
+	}
+	if err := slowRelay.SetCollectTimeout("nope", time.Second); err != relay.UnknownCollector {
+		t.Errorf("Failed to fail setting timeout on unknown collector - %v\n", err)
+	}
+
+	start := time.Now()
+	info := slowRelay.Info()
+	if time.Since(start) > time.Second {
+		t.Errorf("Info was held up by slow collector\n")
+	}
+	if _, ok := info["slow"]; ok {
+		t.Errorf("Slow collector should be missing from info - %v\n", info)
+	}
+	if info["fast"] != 2.0 {
+		t.Errorf("Fast collector missing from info - %v\n", info)
+	}
+
+	// wait out the deadline of any collection the server's poll started
+	time.Sleep(200 * time.Millisecond)
+
+	info = slowRelay.Info()
+	if info["_stalled"] != 1 || info["slow-_stalled"] != 1 {
+		t.Errorf("Expected slow collector to be stalled - %v\n", info)
+	}
+	if info["_timeouts"] < 1 {
+		t.Errorf("Expected slow collector to have timed out - %v\n", info)
+	}
+}
+
+func TestErrCollector(t *testing.T) {
+	errRelay, err := relay.NewRelay(serverAddr, "err_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer errRelay.Close()
+
+	brokenCollector := relay.NewErrPointCollector(func(ctx context.Context) (float64, error) {
+		return 0, errors.New("sensor unplugged")
+	})
+	if err := errRelay.AddCollector("broken", nil, brokenCollector); err != nil {
+		t.Errorf("Failed to add broken collector - %s\n", err)
+		t.FailNow()
+	}
+
+	if values := brokenCollector.Collect(); len(values) != 0 {
+		t.Errorf("Failed collection should have no values - %v\n", values)
+	}
+
+	info := errRelay.Info()
+	if _, ok := info["broken"]; ok {
+		t.Errorf("Broken collector should be missing from info - %v\n", info)
+	}
+	if info["_errors"] < 1 {
+		t.Errorf("Expected broken collector to have errored - %v\n", info)
+	}
+}
+
+func TestCounterCollector(t *testing.T) {
+	count := 1000.0
+	counter := relay.NewCounterCollector(func() float64 {
+		return count
+	}, relay.Wrap32)
+
+	if rates := counter.Collect(); len(rates) != 0 {
+		t.Errorf("First sample should report nothing - %v\n", rates)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	count += 10
+	rate := counter.Collect()[""]
+	if rate <= 0 || rate > 100 {
+		t.Errorf("Expected rate near 100/s, got %v\n", rate)
+	}
+
+	// counter restarted
+	time.Sleep(100 * time.Millisecond)
+	count = 5
+	rate = counter.Collect()[""]
+	if rate <= 0 || rate > 50 {
+		t.Errorf("Expected reset counter rate near 50/s, got %v\n", rate)
+	}
+
+	// counter rolled over
+	time.Sleep(100 * time.Millisecond)
+	count = relay.Wrap32 - 5
+	counter.Collect()
+	time.Sleep(100 * time.Millisecond)
+	count = 5
+	rate = counter.Collect()[""]
+	if rate <= 0 || rate > 100 {
+		t.Errorf("Expected wrapped counter rate near 100/s, got %v\n", rate)
+	}
+}
+
+func TestSummaryCollector(t *testing.T) {
+	latency := relay.NewSummaryCollector(50, 99.9)
+	for i := 1; i <= 1000; i++ {
+		latency.Observe(float64(i))
+	}
+
+	if snapshot := latency.Snapshot(); snapshot["_count"] != 1000 {
+		t.Errorf("Snapshot missing observations - %v\n", snapshot)
+	}
+
+	values := latency.Collect()
+	if values["_count"] != 1000 || values["_sum"] != 500500 {
+		t.Errorf("Bad count or sum - %v\n", values)
+	}
+	if values["_min"] != 1 || values["_max"] != 1000 {
+		t.Errorf("Bad min or max - %v\n", values)
+	}
+	if values["_p50"] != 500 || values["_p99_9"] != 999 {
+		t.Errorf("Bad percentiles - %v\n", values)
+	}
+
+	values = latency.Collect()
+	if values["_count"] != 0 {
+		t.Errorf("Collect didn't start a new interval - %v\n", values)
+	}
+	if _, ok := values["_p50"]; ok {
+		t.Errorf("Empty interval shouldn't report percentiles - %v\n", values)
+	}
+}
+
+func TestHistogramCollector(t *testing.T) {
+	sizes := relay.NewHistogramCollector(100, 0.5, 10)
+	for _, v := range []float64{0.1, 5, 50, 500} {
+		sizes.Observe(v)
+	}
+
+	values := sizes.Collect()
+	if values["_count"] != 4 || values["_le_0_5"] != 1 || values["_le_10"] != 2 || values["_le_100"] != 3 {
+		t.Errorf("Bad histogram - %v\n", values)
+	}
+	if values = sizes.Collect(); values["_le_100"] != 0 {
+		t.Errorf("Collect didn't start a new interval - %v\n", values)
+	}
+}
+
+func TestSampledCollector(t *testing.T) {
+	readings := make(chan float64, 10)
+	for _, v := range []float64{1, 9, 2} {
+		readings <- v
+	}
+	last := 0.0
+	cpu := relay.NewSampledCollector(relay.NewPointCollector(func() float64 {
+		select {
+		case last = <-readings:
+		default:
+		}
+		return last
+	}), 10*time.Millisecond)
+	defer cpu.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	values := cpu.Collect()
+	if values["#min"] != 1 || values["#max"] != 9 || values["#last"] != 2 {
+		t.Errorf("Bad sample summary - %v\n", values)
+	}
+	if values["#mean"] <= 1 || values["#mean"] >= 9 {
+		t.Errorf("Bad sample mean - %v\n", values)
+	}
+
+	// slowing the sampler down takes effect right away
+	cpu.SetInterval(time.Hour)
+	time.Sleep(20 * time.Millisecond)
+	cpu.Collect()
+	time.Sleep(50 * time.Millisecond)
+	if values = cpu.Collect(); len(values) != 0 {
+		t.Errorf("Collector sampled after its interval was raised - %v\n", values)
+	}
+
+	cpu.Close()
+	time.Sleep(20 * time.Millisecond)
+	cpu.Collect()
+	if values = cpu.Collect(); len(values) != 0 {
+		t.Errorf("Closed collector kept sampling - %v\n", values)
+	}
+
+	// an interval that isn't positive falls back to the default
+	for _, interval := range []time.Duration{0, -time.Second} {
+		unset := relay.NewSampledCollector(relay.NewPointCollector(func() float64 { return 1 }), interval)
+		time.Sleep(10 * time.Millisecond)
+		if values = unset.Snapshot(); values["#last"] != 1 {
+			t.Errorf("Collector without an interval didn't sample - %v\n", values)
+		}
+		unset.Close()
+	}
+}
+
+func TestFailover(t *testing.T) {
+	// nothing listens on the primary, so the relay should fail over
+	failRelay, err := relay.NewRelay("127.0.0.1:9896,"+serverAddr, "failover_client")
+	if err != nil {
+		t.Errorf("Failed to fail over - %s\n", err)
+		t.FailNow()
+	}
+	defer failRelay.Close()
+
+	if err := failRelay.AddCollector("ram", nil, relay.NewPointCollector(func() float64 { return 1 })); err != nil {
+		t.Errorf("Failed to add collector to backup server - %s\n", err)
+	}
+
+	if _, err := relay.NewRelay("127.0.0.1:9896", "lonely_client"); err == nil {
+		t.Errorf("Failed to fail connecting to missing server\n")
+	}
+}
+
+func TestCancelHandshake(t *testing.T) {
+	// a server that never answers 'id'
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen - %s", err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hungUp := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			hungUp <- err
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		cancel()
+
+		// the relay should hang up rather than wait out the deadline
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = reader.ReadString('\n')
+		hungUp <- err
+	}()
+
+	if _, err := relay.NewRelayContext(ctx, listener.Addr().String(), "impatient_client"); err != relay.RelayClosed {
+		t.Errorf("Expected the relay to be closed, got %v\n", err)
+	}
+	if err := <-hungUp; err != io.EOF {
+		t.Errorf("Expected the relay to close its connection, got %v\n", err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctxRelay, err := relay.NewRelayContext(ctx, serverAddr, "ctx_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	sampled := relay.NewSampledCollector(relay.NewPointCollector(func() float64 { return 1 }), 10*time.Millisecond)
+	if err := ctxRelay.AddCollector("sampled", nil, sampled); err != nil {
+		t.Errorf("Failed to add collector - %s\n", err)
+	}
+
+	cancel()
+	select {
+	case <-ctxRelay.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Relay didn't stop when its context ended\n")
+	}
+
+	closeRelay, err := relay.NewRelay(serverAddr, "close_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	closeRelay.Close()
+	closeRelay.Close()
+	select {
+	case <-closeRelay.Done():
+	default:
+		t.Errorf("Relay not done after close\n")
+	}
+	if err := closeRelay.AddCollector("late", nil, relay.NewPointCollector(func() float64 { return 1 })); err == nil {
+		t.Errorf("Failed to fail adding collector to closed relay\n")
+	}
+
+	// give the server a moment to notice the disconnects
+	for i := 0; i < 20 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines\n", after-before)
+	}
+}
+
+func TestConcurrentCollectors(t *testing.T) {
+	workerRelay, err := relay.NewRelay(serverAddr, "worker_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer workerRelay.Close()
+
+	// one collector per spawned worker, coming and going
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("worker%d", i)
+			for j := 0; j < 10; j++ {
+				if err := workerRelay.AddCollector(name, nil, relay.NewPointCollector(func() float64 { return 1 })); err != nil {
+					t.Errorf("Failed to add %s - %s\n", name, err)
+					return
+				}
+				workerRelay.SetCollectTimeout(name, time.Second)
+				workerRelay.Info()
+				workerRelay.RemoveCollector(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	info := workerRelay.Info()
+	for name := range info {
+		if strings.HasPrefix(name, "worker") {
+			t.Errorf("Collector %s left behind\n", name)
+		}
+	}
+}
+
+func TestScrapeCollectors(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/metrics":
+			rw.Write([]byte(`# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{method="get",code="200"} 1027 1395066363000
+http_requests_total{code="400",method="post"} 3
+go_goroutines 12
+weird{path="/a \"b\""} 1
+multiline{reason="a\nb"} 2
+missing NaN
+`))
+		case "/debug/vars":
+			rw.Write([]byte(`{"cmdline":["app"],"memstats":{"Alloc":1024,"GC":{"on":true}},"requests":7}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer endpoint.Close()
+
+	values, err := relay.NewPrometheusCollector(endpoint.URL + "/metrics").CollectErr(context.Background())
+	if err != nil {
+		t.Errorf("Failed to scrape prometheus metrics - %s\n", err)
+		t.FailNow()
+	}
+	expected := map[string]float64{
+		"http_requests_total.200.get":  1027,
+		"http_requests_total.400.post": 3,
+		"go_goroutines":                12,
+		"weird._a_b":                   1,
+		"multiline.a_b":                2,
+	}
+	if len(values) != len(expected) {
+		t.Errorf("Unexpected prometheus values - %v\n", values)
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s to be %v - %v\n", name, value, values)
+		}
+	}
+
+	values, err = relay.NewJSONCollector(endpoint.URL + "/debug/vars").CollectErr(context.Background())
+	if err != nil {
+		t.Errorf("Failed to scrape json metrics - %s\n", err)
+		t.FailNow()
+	}
+	if len(values) != 3 || values["memstats.Alloc"] != 1024 || values["memstats.GC.on"] != 1 || values["requests"] != 7 {
+		t.Errorf("Unexpected json values - %v\n", values)
+	}
+
+	if _, err := relay.NewJSONCollector(endpoint.URL + "/nope").CollectErr(context.Background()); err == nil {
+		t.Errorf("Failed to fail scraping missing endpoint\n")
+	}
+}
+
+func TestRuntimeCollector(t *testing.T) {
+	rt := relay.NewRuntimeCollector()
+	runtime.GC()
+
+	values := rt.Collect()
+	for _, name := range []string{"go_goroutines", "go_heap_inuse", "go_gc_count", "go_gc_pause_max"} {
+		if values[name] <= 0 {
+			t.Errorf("Expected %s to be reported - %v\n", name, values)
+		}
+	}
+}
+
+func TestLogCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulse-log")
+	if err != nil {
+		t.Errorf("Failed to create temp dir - %s\n", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	appendLog := func(lines string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Errorf("Failed to write log - %s\n", err)
+			t.FailNow()
+		}
+		f.WriteString(lines)
+		f.Close()
+	}
+
+	// history isn't counted
+	appendLog("GET / 500 time=1\n")
+
+	logs, err := relay.NewLogCollector(path, map[string]string{
+		"errors": ` 5\d\d `,
+		"time":   `time=(?P<value>[\d.]+)`,
+	})
+	if err != nil {
+		t.Errorf("Failed to create log collector - %s\n", err)
+		t.FailNow()
+	}
+	defer logs.Close()
+
+	if _, err := relay.NewLogCollector(path, map[string]string{"bad": "("}); err == nil {
+		t.Errorf("Failed to fail on bad pattern\n")
+	}
+
+	appendLog("GET / 200 time=2\nGET / 502 time=4\nGET / 503 ti")
+	values := logs.Collect()
+	if values["errors"] != 1 || values["time"] != 2 || values["time_sum"] != 6 || values["time_max"] != 4 {
+		t.Errorf("Unexpected log values - %v\n", values)
+	}
+
+	// finish the partial line then rotate
+	appendLog("me=6\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Errorf("Failed to rotate log - %s\n", err)
+		t.FailNow()
+	}
+	appendLog("GET / 500 time=1\n")
+	values = logs.Collect()
+	if values["errors"] != 2 || values["time"] != 2 || values["time_sum"] != 7 {
+		t.Errorf("Unexpected values across rotation - %v\n", values)
+	}
+
+	// truncate (to less than was read, or it looks like nothing changed)
+	if err := ioutil.WriteFile(path, []byte("200 time=1\n"), 0644); err != nil {
+		t.Errorf("Failed to truncate log - %s\n", err)
+		t.FailNow()
+	}
+	values = logs.Collect()
+	if values["errors"] != 0 || values["time"] != 1 {
+		t.Errorf("Unexpected values after truncation - %v\n", values)
+	}
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// RuntimePrefix starts the name of every value the runtime collector reports.
+// It is reserved for the runtime collector, other collectors' values starting
+// with it are reported with the collector's name in front (eg. a scraped
+// "go_goroutines" of collector "app" as "app_go_goroutines").
+const RuntimePrefix = "go_"
+
+type (
+	// runtimeCollector reports the health of the program embedding the relay
+	runtimeCollector struct {
+		mu     sync.Mutex
+		lastGC uint32 // NumGC at the last collection
+	}
+)
+
+// NewRuntimeCollector creates a collector reporting the health of the Go
+// program embedding the relay:
+//
+//	go_goroutines      number of goroutines
+//	go_heap_inuse      bytes in in-use heap spans
+//	go_heap_alloc      bytes of allocated heap objects
+//	go_sys             bytes obtained from the OS
+//	go_gc_count        garbage collections since the program started
+//	go_gc_pause_p50    median GC pause (seconds) since the last collection
+//	go_gc_pause_p99    99th percentile GC pause (seconds) since the last collection
+//	go_gc_pause_max    longest GC pause (seconds) since the last collection
+//	go_fds             open file descriptors (linux only)
+//
+// Pause percentiles are only reported when a collection happened since the
+// last one.
+func NewRuntimeCollector() Collector {
+	return &runtimeCollector{}
+}
+
+// isRuntime reports whether a collector is (or samples) a runtime collector
+func isRuntime(c Collector) bool {
+	if sampled, ok := c.(*Sampled); ok {
+		c = sampled.collector
+	}
+	_, ok := c.(*runtimeCollector)
+	return ok
+}
+
+func (r *runtimeCollector) Collect() map[string]float64 {
+	return r.collect(true)
+}
+
+// Snapshot reports the same values as Collect without starting a new
+// interval for pause percentiles
+func (r *runtimeCollector) Snapshot() map[string]float64 {
+	return r.collect(false)
+}
+
+func (r *runtimeCollector) collect(advance bool) map[string]float64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	values := map[string]float64{
+		RuntimePrefix + "goroutines": float64(runtime.NumGoroutine()),
+		RuntimePrefix + "heap_inuse": float64(mem.HeapInuse),
+		RuntimePrefix + "heap_alloc": float64(mem.HeapAlloc),
+		RuntimePrefix + "sys":        float64(mem.Sys),
+		RuntimePrefix + "gc_count":   float64(mem.NumGC),
+	}
+
+	r.mu.Lock()
+	pauses := recentPauses(&mem, r.lastGC)
+	if advance {
+		r.lastGC = mem.NumGC
+	}
+	r.mu.Unlock()
+
+	if len(pauses) > 0 {
+		sort.Float64s(pauses)
+		values[RuntimePrefix+"gc_pause_p50"] = pauses[(len(pauses)-1)/2]
+		values[RuntimePrefix+"gc_pause_p99"] = pauses[(len(pauses)-1)*99/100]
+		values[RuntimePrefix+"gc_pause_max"] = pauses[len(pauses)-1]
+	}
+
+	// linux exposes the process' open files in /proc
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		values[RuntimePrefix+"fds"] = float64(len(fds))
+	}
+
+	return values
+}
+
+// recentPauses returns the pauses (in seconds) of the collections after the
+// given collection count, as far back as the runtime remembers
+func recentPauses(mem *runtime.MemStats, since uint32) []float64 {
+	count := mem.NumGC - since
+	if count > uint32(len(mem.PauseNs)) {
+		count = uint32(len(mem.PauseNs))
+	}
+
+	pauses := make([]float64, 0, count)
+	for i := uint32(0); i < count; i++ {
+		// PauseNs is a circular buffer, the latest pause is at (NumGC+255)%256
+		idx := (mem.NumGC - i + uint32(len(mem.PauseNs)) - 1) % uint32(len(mem.PauseNs))
+		pauses = append(pauses, float64(mem.PauseNs[idx])/1e9)
+	}
+	return pauses
+}
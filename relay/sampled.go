@@ -0,0 +1,176 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultSampleInterval is used when a Sampled collector is given an interval
+// that isn't positive
+var DefaultSampleInterval = time.Second
+
+type (
+	// Sampled is a collector that samples another at a faster, local rate and
+	// reports the mean, min, max and last of each value since the previous
+	// poll, so spikes between polls aren't missed. They're the fields "mean",
+	// "min", "max" and "last" of the value's name: a value "cpu" of the
+	// sampled collector is reported as "cpu#mean" and so on (or "#mean"...
+	// for an unnamed value, fields of the collector's name).
+	Sampled struct {
+		collector Collector
+
+		mu       sync.Mutex
+		interval time.Duration
+		samples  map[string]*sample
+		reset    chan struct{} // signals the sampler that the interval changed
+
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+
+	// sample aggregates one value's samples
+	sample struct {
+		count int
+		sum   float64
+		min   float64
+		max   float64
+		last  float64
+	}
+)
+
+// NewSampledCollector creates a Sampled collector sampling c every interval
+// (DefaultSampleInterval if it isn't positive) until it is closed. The relay
+// closes it when the collector is removed.
+func NewSampledCollector(c Collector, interval time.Duration) *Sampled {
+	if interval <= 0 {
+		interval = DefaultSampleInterval
+	}
+	s := &Sampled{
+		collector: c,
+		interval:  interval,
+		samples:   make(map[string]*sample),
+		reset:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// run samples the collector until closed
+func (s *Sampled) run() {
+	s.sample()
+
+	tick := time.NewTicker(s.sampleInterval())
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			s.sample()
+		case <-s.reset:
+			tick.Reset(s.sampleInterval())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sample takes a single sample, failed samples are skipped
+func (s *Sampled) sample() {
+	var values map[string]float64
+	if errCollector, ok := s.collector.(ErrCollector); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), s.sampleInterval())
+		var err error
+		values, err = errCollector.CollectErr(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+	} else {
+		values = s.collector.Collect()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, value := range values {
+		smp, ok := s.samples[name]
+		if !ok {
+			smp = &sample{}
+			s.samples[name] = smp
+		}
+		if smp.count == 0 || value < smp.min {
+			smp.min = value
+		}
+		if smp.count == 0 || value > smp.max {
+			smp.max = value
+		}
+		smp.count++
+		smp.sum += value
+		smp.last = value
+	}
+}
+
+// sampleInterval returns how often the collector is sampled
+func (s *Sampled) sampleInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.interval
+}
+
+// SetInterval changes how often the collector is sampled, starting from now
+func (s *Sampled) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.interval = interval
+	s.mu.Unlock()
+
+	// the sampler only needs to know that it changed, not how many times
+	select {
+	case s.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Collect reports the summary of each value since the last collection and
+// starts a new interval
+func (s *Sampled) Collect() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := s.peek()
+	s.samples = make(map[string]*sample, len(s.samples))
+	return values
+}
+
+// Snapshot reports the summary of each value so far without resetting it
+func (s *Sampled) Snapshot() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peek()
+}
+
+// peek summarizes the samples, the caller must hold the lock
+func (s *Sampled) peek() map[string]float64 {
+	values := make(map[string]float64, len(s.samples)*4)
+	for name, smp := range s.samples {
+		values[name+FieldSeparator+"mean"] = smp.sum / float64(smp.count)
+		values[name+FieldSeparator+"min"] = smp.min
+		values[name+FieldSeparator+"max"] = smp.max
+		values[name+FieldSeparator+"last"] = smp.last
+	}
+	return values
+}
+
+// Close stops sampling
+func (s *Sampled) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
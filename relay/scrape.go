@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// scrapeClient fetches endpoints for scrape collectors. Collections made
+	// by the relay are also bound by the collector's deadline.
+	scrapeClient = &http.Client{Timeout: 10 * time.Second}
+
+	// nameReplacer replaces characters pulse reserves or influx chokes on
+	nameReplacer = strings.NewReplacer("-", "_", ":", "_", ",", "_", " ", "_", ".", "_", "/", "_", "\"", "", "=", "_", "\n", "_", "\r", "_", FieldSeparator, "_")
+)
+
+type (
+	// scraper is a collector that fetches and parses an http endpoint
+	scraper struct {
+		url   string
+		parse func(io.Reader) (map[string]float64, error)
+	}
+)
+
+// NewPrometheusCollector creates a collector that scrapes an endpoint
+// exposing metrics in the Prometheus text format (eg.
+// "http://127.0.0.1:9100/metrics"). Each sample is reported under its metric
+// name followed by the values of its labels, sorted by label name, as dotted
+// segments, so `http_requests_total{code="200",method="get"}` becomes
+// "http_requests_total.200.get". A name template (eg.
+// "http_requests_total.*.* measurement.code.method") turns them into tags.
+// NaN and infinite samples are skipped.
+func NewPrometheusCollector(url string) ErrCollector {
+	return &scraper{url: url, parse: parsePrometheus}
+}
+
+// NewJSONCollector creates a collector that scrapes an endpoint exposing
+// metrics as a JSON object (eg. expvar's "http://127.0.0.1:8080/debug/vars").
+// Nested objects are flattened, joining keys with '.' like Prometheus labels,
+// so {"memstats": {"Alloc": 1}} becomes "memstats.Alloc" and a name template
+// (eg. "memstats.* measurement.field") can map it. Booleans are reported as 1
+// or 0; strings, nulls and arrays are skipped.
+func NewJSONCollector(url string) ErrCollector {
+	return &scraper{url: url, parse: parseJSON}
+}
+
+// Collect drops the values of a failed scrape
+func (s *scraper) Collect() map[string]float64 {
+	values, err := s.CollectErr(context.Background())
+	if err != nil {
+		return map[string]float64{}
+	}
+	return values
+}
+
+func (s *scraper) CollectErr(ctx context.Context) (map[string]float64, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scrapeClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to scrape %s - %s", s.url, res.Status)
+	}
+
+	return s.parse(res.Body)
+}
+
+// scrapeName makes a scraped name safe to report
+func scrapeName(name string) string {
+	return nameReplacer.Replace(name)
+}
+
+// parsePrometheus parses the Prometheus text exposition format
+func parsePrometheus(r io.Reader) (map[string]float64, error) {
+	values := map[string]float64{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// skip blanks and HELP/TYPE comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, rest, err := splitSample(line)
+		if err != nil {
+			return nil, err
+		}
+
+		// rest is "value [timestamp]"
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("Missing value - '%s'", line)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad value - '%s'", line)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+
+		// labels follow the name as dotted segments, so name templates can
+		// map them to tags
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		segments := []string{scrapeName(name)}
+		for _, key := range keys {
+			segments = append(segments, scrapeName(labels[key]))
+		}
+
+		values[strings.Join(segments, ".")] = value
+	}
+
+	return values, scanner.Err()
+}
+
+// splitSample splits a sample line into its metric name, labels and the rest
+// of the line
+func splitSample(line string) (string, map[string]string, string, error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end == -1 {
+		return "", nil, "", fmt.Errorf("Missing value - '%s'", line)
+	}
+	name := line[:end]
+	labels := map[string]string{}
+	if line[end] != '{' {
+		return name, labels, line[end:], nil
+	}
+
+	// parse `key="value",...}` honoring escapes in values
+	i := end + 1
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == ',') {
+			i++
+		}
+		if i < len(line) && line[i] == '}' {
+			return name, labels, line[i+1:], nil
+		}
+
+		eq := strings.IndexByte(line[i:], '=')
+		if eq == -1 || i+eq+1 >= len(line) || line[i+eq+1] != '"' {
+			return "", nil, "", fmt.Errorf("Bad labels - '%s'", line)
+		}
+		key := strings.TrimSpace(line[i : i+eq])
+		i += eq + 2
+
+		value := []byte{}
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+				if line[i] == 'n' {
+					value = append(value, '\n')
+					continue
+				}
+			}
+			value = append(value, line[i])
+		}
+		if i >= len(line) {
+			return "", nil, "", fmt.Errorf("Unterminated label value - '%s'", line)
+		}
+		i++ // closing quote
+		labels[key] = string(value)
+	}
+}
+
+// parseJSON parses a (nested) JSON object of values
+func parseJSON(r io.Reader) (map[string]float64, error) {
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	values := map[string]float64{}
+	flatten("", doc, values)
+	return values, nil
+}
+
+// flatten adds the values of obj to values, prefixing their names
+func flatten(prefix string, obj map[string]interface{}, values map[string]float64) {
+	for key, v := range obj {
+		name := scrapeName(key)
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		switch v := v.(type) {
+		case json.Number:
+			if value, err := v.Float64(); err == nil {
+				values[name] = value
+			}
+		case bool:
+			values[name] = 0
+			if v {
+				values[name] = 1
+			}
+		case map[string]interface{}:
+			flatten(name, v, values)
+		}
+	}
+}
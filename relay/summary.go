@@ -0,0 +1,221 @@
+package relay
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// SummarySamples caps how many observations a Summary keeps per interval
+	// for estimating percentiles. Count, sum, min and max are always exact.
+	SummarySamples = 1028
+
+	// DefaultPercentiles are reported by a Summary created without any
+	DefaultPercentiles = []float64{50, 90, 99}
+)
+
+type (
+	// observations accumulates the values observed since the last collection
+	observations struct {
+		mu    sync.Mutex
+		count int
+		sum   float64
+		min   float64
+		max   float64
+	}
+
+	// Summary is a collector for values observed between polls, such as
+	// request latencies. Each collection reports the count, sum, min and max
+	// of the values observed since the previous one along with the configured
+	// percentiles, then starts a new interval.
+	Summary struct {
+		observations
+		percentiles []float64
+		samples     []float64
+		rand        *rand.Rand
+	}
+
+	// Histogram is a collector for values observed between polls. Each
+	// collection reports the count, sum, min and max of the values observed
+	// since the previous one along with how many were at or below each bucket
+	// bound, then starts a new interval.
+	Histogram struct {
+		observations
+		buckets []float64
+		counts  []int
+	}
+)
+
+// observe records v, the caller must hold the lock
+func (o *observations) observe(v float64) {
+	if o.count == 0 || v < o.min {
+		o.min = v
+	}
+	if o.count == 0 || v > o.max {
+		o.max = v
+	}
+	o.count++
+	o.sum += v
+}
+
+// values returns the interval's aggregates, the caller must hold the lock.
+// Names start with '_' so the relay reports them as suffixes of the
+// collector's name (eg. "latency_count").
+func (o *observations) values() map[string]float64 {
+	values := map[string]float64{
+		"_count": float64(o.count),
+		"_sum":   o.sum,
+	}
+	if o.count > 0 {
+		values["_min"] = o.min
+		values["_max"] = o.max
+	}
+	return values
+}
+
+// reset starts a new interval, the caller must hold the lock
+func (o *observations) reset() {
+	o.count = 0
+	o.sum = 0
+	o.min = 0
+	o.max = 0
+}
+
+// NewSummaryCollector creates a Summary reporting the given percentiles
+// (0-100, eg. 50, 99, 99.9) of each interval's observations
+func NewSummaryCollector(percentiles ...float64) *Summary {
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	return &Summary{
+		percentiles: percentiles,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Observe records a value
+func (s *Summary) Observe(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.observe(v)
+
+	// keep a uniform sample of the interval's values (reservoir sampling)
+	if len(s.samples) < SummarySamples {
+		s.samples = append(s.samples, v)
+		return
+	}
+	if i := s.rand.Intn(s.count); i < len(s.samples) {
+		s.samples[i] = v
+	}
+}
+
+// Collect reports the interval's aggregates and starts a new interval
+func (s *Summary) Collect() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := s.peek()
+	s.reset()
+	s.samples = s.samples[:0]
+	return values
+}
+
+// peek reports the interval's aggregates without starting a new interval,
+// the caller must hold the lock
+func (s *Summary) peek() map[string]float64 {
+	values := s.values()
+	if len(s.samples) == 0 {
+		return values
+	}
+
+	sorted := make([]float64, len(s.samples))
+	copy(sorted, s.samples)
+	sort.Float64s(sorted)
+
+	for _, p := range s.percentiles {
+		// nearest rank, allowing for float error (99.9/100 isn't exact)
+		rank := int(math.Ceil(p/100*float64(len(sorted)) - 1e-9))
+		if rank < 1 {
+			rank = 1
+		}
+		if rank > len(sorted) {
+			rank = len(sorted)
+		}
+		values["_p"+boundName(p)] = sorted[rank-1]
+	}
+	return values
+}
+
+// Snapshot reports the interval's aggregates so far without resetting them
+func (s *Summary) Snapshot() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peek()
+}
+
+// NewHistogramCollector creates a Histogram counting observations at or
+// below each of the given bucket bounds
+func NewHistogramCollector(buckets ...float64) *Histogram {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+	return &Histogram{
+		buckets: sorted,
+		counts:  make([]int, len(sorted)),
+	}
+}
+
+// Observe records a value
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.observe(v)
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+// Collect reports the interval's aggregates and starts a new interval
+func (h *Histogram) Collect() map[string]float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	values := h.peek()
+	h.reset()
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	return values
+}
+
+// peek reports the interval's aggregates without starting a new interval,
+// the caller must hold the lock
+func (h *Histogram) peek() map[string]float64 {
+	values := h.values()
+	for i, bound := range h.buckets {
+		values["_le_"+boundName(bound)] = float64(h.counts[i])
+	}
+	return values
+}
+
+// Snapshot reports the interval's aggregates so far without resetting them
+func (h *Histogram) Snapshot() map[string]float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.peek()
+}
+
+// boundName formats a percentile or bucket bound for use in a stat name
+// (eg. 99.9 becomes "99_9")
+func boundName(v float64) string {
+	return strings.NewReplacer(".", "_", "-", "neg", "+", "").Replace(strconv.FormatFloat(v, 'f', -1, 64))
+}
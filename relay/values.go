@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// MaxStringValue is the longest string value, in bytes, a relay sends
+var MaxStringValue = 256
+
+// normalize converts a collected value to a float64, int64, bool or string,
+// the types the protocol carries
+func normalize(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return normalize(uint64(v))
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return float64(v), true
+		}
+		return int64(v), true
+	case bool:
+		return v, true
+	case string:
+		if len(v) <= MaxStringValue {
+			return v, true
+		}
+		// don't cut a multi-byte character in half
+		cut := MaxStringValue
+		for cut > 0 && !utf8.RuneStart(v[cut]) {
+			cut--
+		}
+		return v[:cut], true
+	}
+	return nil, false
+}
+
+// encodeValue formats a normalized value for a 'got' response. Floats are
+// sent at full precision, integers end in 'i' and strings are quoted so they
+// may hold any character.
+func encodeValue(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return strconv.Quote(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return ""
+}
+
+// floatValue converts numbers and booleans to a float, for places that only
+// deal in floats (eg. Info)
+func floatValue(value interface{}) (float64, bool) {
+	v, ok := normalize(value)
+	if !ok {
+		return 0, false
+	}
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// typedValues widens float values for the typed collection path
+func typedValues(values map[string]float64) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	typed := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		typed[name] = value
+	}
+	return typed
+}
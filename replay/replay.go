@@ -0,0 +1,239 @@
+// Package replay re-publishes archived stats, or captured relay traffic,
+// through a plexer. It backfills publishers after an outage and load-tests
+// them with realistic data.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/pulse/archive"
+	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/server"
+)
+
+var (
+	BadFormat = errors.New("Replay format must be 'jsonl' or 'protocol'")
+
+	// Backoff is how long to wait for publishers with full queues
+	Backoff = 10 * time.Millisecond
+)
+
+type (
+	// Options control how stats are replayed. Format is "jsonl" (an archive)
+	// or "protocol" (what relays sent a server). Speed scales the original
+	// gaps between stats, 2 replays twice as fast and 0 (the default) as
+	// fast as the publishers keep up. Shift is added to every stat's time,
+	// unless Now stamps them with the time they are replayed instead.
+	Options struct {
+		Format string
+		Speed  float64
+		Shift  time.Duration
+		Now    bool
+	}
+
+	// source reads the next message set and when it was collected
+	source func() (plexer.MessageSet, time.Time, error)
+)
+
+// Open opens a file to replay, gunzipping it if it ends in ".gz". "-" is
+// stdin.
+func Open(path string) (io.ReadCloser, error) {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		f, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzReader{gz, f}, nil
+}
+
+// gzReader closes the file under the gzip reader too
+type gzReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzReader) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// Replay publishes the stats read from r, returning how many were published.
+// Archived stats were transformed before they were archived, so only relay
+// traffic goes through the plexer's transforms.
+func Replay(r io.Reader, plex *plexer.Plexer, opts Options) (int, error) {
+	var next source
+	// archives hold stats as already transformed, relay traffic is raw
+	publish := plex.Publish
+	switch opts.Format {
+	case "", "jsonl":
+		next = jsonlSource(bufio.NewReader(r))
+		publish = plex.PublishRaw
+	case "protocol":
+		next = protocolSource(bufio.NewReader(r))
+	default:
+		return 0, BadFormat
+	}
+
+	published := 0
+	var first, start time.Time
+	for {
+		messages, collected, err := next()
+		if err == io.EOF {
+			return published, nil
+		}
+		if err != nil {
+			return published, err
+		}
+
+		// keep the original pace, sped up
+		if opts.Speed > 0 {
+			if first.IsZero() {
+				first, start = collected, time.Now()
+			}
+			wait := time.Until(start.Add(time.Duration(float64(collected.Sub(first)) / opts.Speed)))
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		for i := range messages.Messages {
+			switch {
+			case opts.Now:
+				messages.Messages[i].Time = time.Now()
+			case opts.Shift != 0:
+				messages.Messages[i].Time = messages.Messages[i].Time.Add(opts.Shift)
+			}
+		}
+
+		// backfilling shouldn't drop stats because it outpaces publishers
+		waitForRoom(plex)
+		if err := publish(messages); err != nil {
+			lumber.Error("[PULSE :: REPLAY] Failed to publish %d stats - %s", len(messages.Messages), err)
+			continue
+		}
+		published += len(messages.Messages)
+	}
+}
+
+// waitForRoom waits until no publisher's queue is full
+func waitForRoom(plex *plexer.Plexer) {
+	for {
+		full := false
+		for _, info := range plex.Publishers() {
+			if info.Stats.Queued >= info.Pool.Queue {
+				full = true
+				break
+			}
+		}
+		if !full {
+			return
+		}
+		time.Sleep(Backoff)
+	}
+}
+
+// jsonlSource reads archive records, a set at a time (an archived set's stats
+// share its time)
+func jsonlSource(r *bufio.Reader) source {
+	var pending *plexer.Message
+	return func() (plexer.MessageSet, time.Time, error) {
+		messages := plexer.MessageSet{Tags: []string{}, Messages: []plexer.Message{}}
+		if pending != nil {
+			messages.Messages = append(messages.Messages, *pending)
+			pending = nil
+		}
+
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				record, jerr := archive.ParseRecord(line)
+				if jerr != nil {
+					lumber.Trace("[PULSE :: REPLAY] Bad record: %s", line)
+				} else {
+					message := record.Message()
+					if len(messages.Messages) > 0 && !message.Time.Equal(messages.Messages[0].Time) {
+						pending = &message
+						return messages, messages.Messages[0].Time, nil
+					}
+					messages.Messages = append(messages.Messages, message)
+				}
+			}
+
+			if err != nil {
+				if err == io.EOF && len(messages.Messages) > 0 {
+					return messages, messages.Messages[0].Time, nil
+				}
+				return plexer.MessageSet{}, time.Time{}, err
+			}
+		}
+	}
+}
+
+// protocolSource reads the lines a relay sent a server, each optionally
+// prefixed with the RFC3339 time it was sent, and turns 'got' responses into
+// stats. Responses without a time are stamped with the time they're read.
+func protocolSource(r *bufio.Reader) source {
+	id := ""
+	tags := map[string][]string{}
+	tagList := func(collector string) []string { return tags[collector] }
+
+	return func() (plexer.MessageSet, time.Time, error) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return plexer.MessageSet{}, time.Time{}, err
+			}
+			line = strings.TrimSpace(line)
+
+			sent := time.Now()
+			if split := strings.SplitN(line, " ", 2); len(split) == 2 {
+				if t, terr := time.Parse(time.RFC3339Nano, split[0]); terr == nil {
+					sent, line = t, split[1]
+				}
+			}
+
+			split := strings.SplitN(line, " ", 2)
+			if len(split) != 2 {
+				continue
+			}
+			switch split[0] {
+			case "id":
+				id = split[1]
+			case "add", "tag":
+				collector := strings.SplitN(split[1], ":", 2)
+				tags[collector[0]] = []string{}
+				if len(collector) == 2 && collector[1] != "" {
+					tags[collector[0]] = strings.Split(collector[1], ",")
+				}
+			case "remove":
+				delete(tags, split[1])
+			case "got":
+				messages := server.ParseStats(id, split[1], tagList, sent)
+				if len(messages.Messages) > 0 {
+					return messages, sent, nil
+				}
+			}
+		}
+	}
+}
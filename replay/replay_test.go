@@ -0,0 +1,191 @@
+package replay_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanopack/pulse/archive"
+	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/replay"
+)
+
+// recorder is a batch publisher keeping what it's sent
+type recorder struct {
+	sync.Mutex
+	got []plexer.MessageSet
+}
+
+func (r *recorder) publish(messages plexer.MessageSet) error {
+	r.Lock()
+	r.got = append(r.got, messages)
+	r.Unlock()
+	return nil
+}
+
+// run replays input through a plexer publishing to a recorder
+func run(t *testing.T, input string, opts replay.Options) ([]plexer.MessageSet, int) {
+	rec := &recorder{}
+	plex := plexer.NewPlexer()
+	plex.AddBatcher("recorder", rec.publish)
+
+	count, err := replay.Replay(strings.NewReader(input), plex, opts)
+	if err != nil {
+		t.Fatalf("Failed to replay - %s", err)
+	}
+	plex.Close()
+	return rec.got, count
+}
+
+var start = time.Date(2016, 8, 17, 17, 6, 0, 0, time.UTC)
+
+func TestArchive(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+
+	arch, err := archive.New(dir, archive.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create archive - %s", err)
+	}
+	arch.Publish(plexer.MessageSet{Tags: []string{"host:web1"}, Messages: []plexer.Message{
+		{ID: "cpu_used", Data: "0.34", Value: 0.34, Time: start},
+		{ID: "requests", Data: "42", Value: int64(42), Time: start},
+	}})
+	arch.Publish(plexer.MessageSet{Tags: []string{"host:web1"}, Messages: []plexer.Message{
+		{ID: "healthy", Data: "true", Value: true, Time: start.Add(time.Minute)},
+	}})
+	arch.Close()
+
+	files, _ := arch.Files()
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 archive, got %v", files)
+	}
+	file, err := replay.Open(files[0])
+	if err != nil {
+		t.Fatalf("Failed to open archive - %s", err)
+	}
+	input, _ := ioutil.ReadAll(file)
+	file.Close()
+
+	got, count := run(t, string(input), replay.Options{Shift: time.Hour})
+	if count != 3 || len(got) != 2 || len(got[0].Messages) != 2 {
+		t.Fatalf("Expected stats sharing a time to be replayed together - %+v", got)
+	}
+	requests := got[0].Messages[1]
+	if requests.Value != int64(42) || requests.Data != "42" || len(requests.Tags) != 1 || requests.Tags[0] != "host:web1" {
+		t.Errorf("Stat wasn't replayed as archived - %+v", requests)
+	}
+	if !requests.Time.Equal(start.Add(time.Hour)) || !got[1].Messages[0].Time.Equal(start.Add(time.Hour+time.Minute)) {
+		t.Errorf("Times weren't shifted - %s, %s", requests.Time, got[1].Messages[0].Time)
+	}
+
+	got, _ = run(t, `{"time":"2016-08-17T17:06:00Z","id":"bytes","type":"integer","value":9007199254740993}`, replay.Options{})
+	if len(got) != 1 || got[0].Messages[0].Value != int64(9007199254740993) {
+		t.Errorf("Integer lost precision - %+v", got)
+	}
+
+	if _, err := replay.Replay(strings.NewReader(""), plexer.NewPlexer(), replay.Options{Format: "xml"}); err != replay.BadFormat {
+		t.Errorf("Expected a bad format, got %v", err)
+	}
+}
+
+func TestTransformed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+
+	// archive stats as pulse does, after transforming them
+	scale := []plexer.Transform{{Action: "scale", Regex: "ram_used", Factor: 0.5}}
+	arch, err := archive.New(dir, archive.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create archive - %s", err)
+	}
+	plex := plexer.NewPlexer()
+	plex.AddBatcher("archive", arch.Publish)
+	if err := plex.SetTransforms(scale); err != nil {
+		t.Fatalf("Failed to set transforms - %s", err)
+	}
+	plex.Publish(plexer.MessageSet{Messages: []plexer.Message{{ID: "ram_used", Data: "100", Value: 100.0, Time: start}}})
+	plex.Close()
+	arch.Close()
+
+	files, _ := arch.Files()
+	file, err := replay.Open(files[0])
+	if err != nil {
+		t.Fatalf("Failed to open archive - %s", err)
+	}
+	defer file.Close()
+
+	// and replay them through the same transforms
+	rec := &recorder{}
+	plex = plexer.NewPlexer()
+	plex.AddBatcher("recorder", rec.publish)
+	plex.SetTransforms(scale)
+	if _, err := replay.Replay(file, plex, replay.Options{}); err != nil {
+		t.Fatalf("Failed to replay - %s", err)
+	}
+	plex.Close()
+
+	if len(rec.got) != 1 || rec.got[0].Messages[0].Value != 50.0 {
+		t.Errorf("Archived stats were transformed again - %+v", rec.got)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	capture := strings.Join([]string{
+		"id web1",
+		"add cpu:role:db",
+		"add ram",
+		"2016-08-17T17:06:00Z got cpu-used:0.25,ram-used:12i",
+		"ping",
+		"tag cpu:role:web",
+		"2016-08-17T17:07:00Z got cpu-used:0.5",
+		"got ram-used:\"full\"",
+	}, "\n")
+
+	got, count := run(t, capture, replay.Options{Format: "protocol"})
+	if count != 4 || len(got) != 3 {
+		t.Fatalf("Unexpected replay - %+v", got)
+	}
+	if tags := got[0].Tags; len(tags) != 2 || tags[1] != "host:web1" {
+		t.Errorf("Stats weren't tagged with the relay - %v", tags)
+	}
+	cpu := got[0].Messages[0]
+	if cpu.ID != "used" || cpu.Value != 0.25 || cpu.Tags[0] != "role:db" || !cpu.Time.Equal(start) {
+		t.Errorf("Unexpected stat - %+v", cpu)
+	}
+	if got[0].Messages[1].Value != int64(12) {
+		t.Errorf("Unexpected stat - %+v", got[0].Messages[1])
+	}
+	if cpu := got[1].Messages[0]; cpu.Tags[0] != "role:web" || !cpu.Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("Retagged stat wasn't replayed - %+v", cpu)
+	}
+	if ram := got[2].Messages[0]; ram.Value != "full" || time.Since(ram.Time) > time.Second {
+		t.Errorf("Untimed stat wasn't stamped as it was read - %+v", ram)
+	}
+
+	got, _ = run(t, capture, replay.Options{Format: "protocol", Now: true})
+	if time.Since(got[0].Messages[0].Time) > time.Second {
+		t.Errorf("Stat wasn't stamped with the time it was replayed - %s", got[0].Messages[0].Time)
+	}
+}
+
+func TestSpeed(t *testing.T) {
+	capture := "id web1\n" +
+		"2016-08-17T17:06:00Z got cpu-used:0.25\n" +
+		"2016-08-17T17:06:00.2Z got cpu-used:0.5\n"
+
+	began := time.Now()
+	run(t, capture, replay.Options{Format: "protocol", Speed: 2})
+	if took := time.Since(began); took < 100*time.Millisecond || took > 500*time.Millisecond {
+		t.Errorf("Expected replaying at twice the pace to take 100ms, took %s", took)
+	}
+
+	began = time.Now()
+	run(t, capture, replay.Options{Format: "protocol"})
+	if took := time.Since(began); took > 50*time.Millisecond {
+		t.Errorf("Expected replaying without a speed not to wait, took %s", took)
+	}
+}
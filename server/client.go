@@ -2,6 +2,7 @@ package server
 
 import (
 	"net"
+	"sync"
 )
 
 type (
@@ -12,7 +13,10 @@ type (
 )
 
 var (
-	clients = map[string]*client{}
+	// clients and their collectors are read by the api and pollers while
+	// connections change them, clientLock guards both
+	clients    = map[string]*client{}
+	clientLock sync.RWMutex
 )
 
 //
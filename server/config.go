@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jcelliott/lumber"
+)
+
+type (
+	// Setting is the desired configuration of one of a relay's collectors
+	Setting struct {
+		Enabled  bool   `json:"enabled"`
+		Interval int    `json:"interval,omitempty"` // seconds, for collectors that sample on their own
+		Applied  bool   `json:"applied"`            // whether the relay acknowledged every command
+		Error    string `json:"error,omitempty"`    // the reason the relay rejected a command
+		pending  map[string]bool
+	}
+)
+
+var (
+	InvalidSetting = errors.New("Interval must not be negative")
+
+	// settings are kept per host, then per collector, and survive reconnects
+	settings    = map[string]map[string]*Setting{}
+	settingLock sync.Mutex
+)
+
+// commands returns the lines that bring a relay's collector in line with the setting
+func (s Setting) commands(collector string) []string {
+	cmds := []string{"enable " + collector}
+	if !s.Enabled {
+		cmds[0] = "disable " + collector
+	}
+	if s.Interval > 0 {
+		cmds = append(cmds, fmt.Sprintf("set %s interval %d", collector, s.Interval))
+	}
+	return cmds
+}
+
+// Configure stores the desired setting for a host's collector and, if the
+// host is connected with that collector, sends it right away. Otherwise it
+// is sent when the relay next adds the collector.
+func Configure(id, collector string, setting Setting) error {
+	if setting.Interval < 0 {
+		return InvalidSetting
+	}
+
+	settingLock.Lock()
+	if settings[id] == nil {
+		settings[id] = map[string]*Setting{}
+	}
+	settings[id][collector] = &Setting{Enabled: setting.Enabled, Interval: setting.Interval}
+	settingLock.Unlock()
+
+	clientLock.RLock()
+	client, ok := clients[id]
+	connected := ok && client.includes(collector)
+	clientLock.RUnlock()
+	if connected {
+		applySetting(id, collector)
+	}
+	return nil
+}
+
+// Settings returns the desired settings per host and collector
+func Settings() map[string]map[string]Setting {
+	settingLock.Lock()
+	defer settingLock.Unlock()
+
+	rtn := make(map[string]map[string]Setting, len(settings))
+	for id, collectors := range settings {
+		rtn[id] = make(map[string]Setting, len(collectors))
+		for collector, setting := range collectors {
+			rtn[id][collector] = Setting{
+				Enabled:  setting.Enabled,
+				Interval: setting.Interval,
+				Applied:  setting.Applied,
+				Error:    setting.Error,
+			}
+		}
+	}
+	return rtn
+}
+
+// applySetting sends the desired setting (if any) for a collector to its relay
+func applySetting(id, collector string) {
+	settingLock.Lock()
+	setting, ok := settings[id][collector]
+	if !ok {
+		settingLock.Unlock()
+		return
+	}
+	cmds := setting.commands(collector)
+	setting.Applied = false
+	setting.Error = ""
+	setting.pending = map[string]bool{}
+	for _, cmd := range cmds {
+		setting.pending[cmd] = true
+	}
+	settingLock.Unlock()
+
+	lumber.Trace("[PULSE :: SERVER] Configuring %s on %s: %s", collector, id, cmds)
+	sendAll(strings.Join(cmds, "\n")+"\n", []string{id})
+}
+
+// acknowledge records a relay's response to a configuration command
+func acknowledge(id, cmd, reason string, ok bool) {
+	fields := strings.Fields(cmd)
+	if len(fields) < 2 {
+		return
+	}
+
+	settingLock.Lock()
+	defer settingLock.Unlock()
+
+	setting, found := settings[id][fields[1]]
+	if !found || !setting.pending[cmd] {
+		// an ack for a setting that has since changed
+		return
+	}
+	delete(setting.pending, cmd)
+
+	if !ok {
+		lumber.Error("[PULSE :: SERVER] %s rejected '%s' - %s", id, cmd, reason)
+		setting.Error = reason
+		return
+	}
+	setting.Applied = len(setting.pending) == 0 && setting.Error == ""
+}
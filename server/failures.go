@@ -0,0 +1,54 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Failure tracks the collection failures a relay reported for a collector
+	Failure struct {
+		Count     int       `json:"count"`
+		LastError string    `json:"last_error"`
+		LastTime  time.Time `json:"last_time"`
+	}
+)
+
+var (
+	// failures are kept per host, then per collector, and survive reconnects
+	failures    = map[string]map[string]*Failure{}
+	failureLock sync.RWMutex
+)
+
+// recordFailure counts a failed collection reported by a relay
+func recordFailure(id, collector, reason string) {
+	failureLock.Lock()
+	defer failureLock.Unlock()
+
+	if failures[id] == nil {
+		failures[id] = map[string]*Failure{}
+	}
+	failure, ok := failures[id][collector]
+	if !ok {
+		failure = &Failure{}
+		failures[id][collector] = failure
+	}
+	failure.Count++
+	failure.LastError = reason
+	failure.LastTime = time.Now()
+}
+
+// Failures returns the collection failures reported per host and collector
+func Failures() map[string]map[string]Failure {
+	failureLock.RLock()
+	defer failureLock.RUnlock()
+
+	rtn := make(map[string]map[string]Failure, len(failures))
+	for id, collectors := range failures {
+		rtn[id] = make(map[string]Failure, len(collectors))
+		for collector, failure := range collectors {
+			rtn[id][collector] = *failure
+		}
+	}
+	return rtn
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+)
+
+type (
+	// template maps the dot separated segments of a stat's name to its
+	// measurement, field and tags (graphite style)
+	template struct {
+		filter []string // glob per segment, empty matches any name
+		parts  []string // "measurement", "field", "*" to drop, or a tag key
+	}
+)
+
+var (
+	BadTemplate = errors.New("Templates need a 'measurement' segment and a filter of the same length")
+
+	templates    []template
+	templateLock sync.RWMutex
+)
+
+// SetTemplates replaces the templates used to map hierarchical stat names.
+// Each is "[filter] template", eg. "disk.*.* measurement.device.field" maps
+// "disk.sda.read" to measurement "disk", field "read" and tag "device:sda".
+// The first template whose filter (or, lacking one, whose length) matches a
+// name is used; names no template matches are stored as they are.
+func SetTemplates(specs []string) error {
+	parsed := make([]template, 0, len(specs))
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 || len(fields) > 2 {
+			return BadTemplate
+		}
+		tmpl := template{parts: strings.Split(fields[len(fields)-1], ".")}
+		if len(fields) == 2 {
+			tmpl.filter = strings.Split(fields[0], ".")
+			if len(tmpl.filter) != len(tmpl.parts) {
+				return BadTemplate
+			}
+		}
+		measured := false
+		for _, part := range tmpl.parts {
+			if part == "" {
+				return BadTemplate
+			}
+			measured = measured || part == "measurement"
+		}
+		if !measured {
+			return BadTemplate
+		}
+		parsed = append(parsed, tmpl)
+	}
+
+	templateLock.Lock()
+	templates = parsed
+	templateLock.Unlock()
+	return nil
+}
+
+// matches reports whether the template applies to a name's segments
+func (t template) matches(segments []string) bool {
+	if len(segments) != len(t.parts) {
+		return false
+	}
+	for i, glob := range t.filter {
+		if ok, _ := path.Match(glob, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mapName maps a stat's name to its measurement, field and tags. Without a
+// matching template the name is the measurement and the field is left empty.
+func mapName(name string) (string, string, []string) {
+	segments := strings.Split(name, ".")
+
+	templateLock.RLock()
+	defer templateLock.RUnlock()
+
+	for _, tmpl := range templates {
+		if !tmpl.matches(segments) {
+			continue
+		}
+		measurement, field, tags := []string{}, []string{}, []string{}
+		for i, part := range tmpl.parts {
+			switch part {
+			case "measurement":
+				measurement = append(measurement, segments[i])
+			case "field":
+				field = append(field, segments[i])
+			case "*":
+			default:
+				tags = append(tags, part+":"+segments[i])
+			}
+		}
+		return strings.Join(measurement, "."), strings.Join(field, "_"), tags
+	}
+	return name, "", nil
+}
@@ -77,22 +77,22 @@ func Poll(tags []string) {
 
 // PollAll polls all clients for registered collectors(stats to be collected)
 func PollAll() {
+	clientLock.RLock()
+	defer clientLock.RUnlock()
 	lumber.Trace("[PULSE :: SERVER] PollAll: %d clients connected...", len(clients))
-	// todo: RLock()
-	for id := range clients {
-		command := "get " + strings.Join(clients[id].collectorList(), ",") + "\n"
+	for id, c := range clients {
+		command := "get " + strings.Join(c.collectorList(), ",") + "\n"
 		if command == "get \n" {
 			continue
 		}
 
-		go func(id string) {
-			lumber.Trace("[PULSE :: SERVER] PollAll-ing: %s - %v...", id, clients[id])
-			_, err := clients[id].conn.Write([]byte(command))
+		go func(id string, c *client) {
+			lumber.Trace("[PULSE :: SERVER] PollAll-ing: %s...", id)
+			_, err := c.conn.Write([]byte(command))
 			if err != nil {
 				lumber.Trace("[PULSE :: SERVER] PollAll: Error - %s", err)
-				delete(clients, id)
-				clients[id].conn.Close()
+				forget(id, c)
 			}
-		}(id)
+		}(id, c)
 	}
 }
@@ -102,7 +102,9 @@ func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	dataChan := make(chan string)
-	errChan := make(chan error)
+	// buffered so the reader can report the closed connection and exit once
+	// we've stopped listening
+	errChan := make(chan error, 1)
 
 	go readData(conn, dataChan, errChan)
 
@@ -127,9 +129,18 @@ func handleConnection(conn net.Conn) {
 	}
 
 	id := split[1]
-	defer delete(clients, id)
+	defer func() {
+		clientLock.Lock()
+		// unless the relay has since reconnected
+		if c, ok := clients[id]; ok && c.conn == conn {
+			delete(clients, id)
+		}
+		clientLock.Unlock()
+	}()
 
+	clientLock.Lock()
 	clients[id] = &client{conn: conn}
+	clientLock.Unlock()
 	conn.Write([]byte("ok\n"))
 
 	// update client with configured beat-interval
@@ -159,7 +170,10 @@ func handleConnection(conn net.Conn) {
 			// this alleviates an edge case where add is called on a client
 			// that doesn't exist.
 			// todo: actually reproduce with pulse relay.
-			if _, ok := clients[id]; !ok {
+			clientLock.RLock()
+			self, ok := clients[id]
+			clientLock.RUnlock()
+			if !ok {
 				lumber.Error("[PULSE :: SERVER] No client found for: %s", id)
 				return
 			}
@@ -168,45 +182,34 @@ func handleConnection(conn net.Conn) {
 			switch cmd {
 			case "ok":
 				lumber.Trace("[PULSE :: SERVER] OK: %s", split)
-				// just an ack
+				// just an ack, unless it's for a configuration command
+				acknowledge(id, split[1], "", true)
+			case "err":
+				lumber.Trace("[PULSE :: SERVER] ERR: %s", split)
+				// the relay rejected a configuration command
+				split = strings.SplitN(split[1], ":", 2)
+				reason := ""
+				if len(split) == 2 {
+					reason = split[1]
+				}
+				acknowledge(id, split[0], reason, false)
 			case "got":
 				lumber.Trace("[PULSE :: SERVER] GOT: %s", split)
-				stats := strings.Split(split[1], ",")
-
-				metric := plexer.MessageSet{
-					Tags:     []string{"metrics", "host:" + id},
-					Messages: make([]plexer.Message, 0),
+				// publishers may batch the stats and store them later
+				clientLock.RLock()
+				metric := ParseStats(id, split[1], self.tagList, time.Now())
+				clientLock.RUnlock()
+				if err := publish(metric); err != nil {
+					// publishers are falling behind, the stats are lost for them
+					lumber.Error("[PULSE :: SERVER] Failed to publish stats from %s - %s", id, err)
 				}
-
-				for _, stat := range stats {
-					// stat may be "test-test:25.25"
-					splitStat := strings.Split(stat, ":")
-					if len(splitStat) != 2 {
-						// i can only handle key value
-						continue
-					}
-					// splitstat would be ["test-test", "25.25"]
-
-					name := splitStat[0]
-					splitName := strings.Split(name, "-")
-					if len(splitName) != 2 {
-						// the name didnt come in as collector-name
-						continue
-					}
-					tags := clients[id].tagList(splitName[0])
-					message := plexer.Message{
-						ID:   splitName[1],
-						Tags: tags,
-						Data: splitStat[1],
-					}
-
-					metric.Messages = append(metric.Messages, message)
-				}
-				publish(metric)
 			case "add":
 				lumber.Trace("[PULSE :: SERVER] ADD: %s", split)
 				if !strings.Contains(split[1], ":") {
-					clients[id].add(split[1], []string{})
+					clientLock.Lock()
+					self.add(split[1], []string{})
+					clientLock.Unlock()
+					applySetting(id, split[1])
 					continue
 				}
 				split = strings.SplitN(split[1], ":", 2)
@@ -214,11 +217,43 @@ func handleConnection(conn net.Conn) {
 				if split[1] == "" {
 					tags = []string{}
 				}
-				clients[id].add(split[0], tags)
-
+				clientLock.Lock()
+				self.add(split[0], tags)
+				clientLock.Unlock()
+				// re-apply anything configured for the collector while it was away
+				applySetting(id, split[0])
+
+			case "tag":
+				lumber.Trace("[PULSE :: SERVER] TAG: %s", split)
+				// new tags for a collector the relay already added
+				split = strings.SplitN(split[1], ":", 2)
+				tags := []string{}
+				if len(split) == 2 && split[1] != "" {
+					tags = strings.Split(split[1], ",")
+				}
+				clientLock.Lock()
+				known := self.includes(split[0])
+				if known {
+					self.add(split[0], tags)
+				}
+				clientLock.Unlock()
+				if !known {
+					lumber.Trace("[PULSE :: SERVER] Can't tag unknown collector: %s", split[0])
+				}
+			case "fail":
+				lumber.Trace("[PULSE :: SERVER] FAIL: %s", split)
+				// the relay couldn't collect a stat, count it rather than storing a bad value
+				split = strings.SplitN(split[1], ":", 2)
+				reason := ""
+				if len(split) == 2 {
+					reason = split[1]
+				}
+				recordFailure(id, split[0], reason)
 			case "remove":
 				lumber.Trace("[PULSE :: SERVER] REMOVE: %s", split)
-				clients[id].remove(split[1])
+				clientLock.Lock()
+				self.remove(split[1])
+				clientLock.Unlock()
 				// record that the remote does not have a stat available
 			case "close":
 				lumber.Trace("[PULSE :: SERVER] CLOSE: %s", split)
@@ -238,7 +273,8 @@ func handleConnection(conn net.Conn) {
 // returns the server ids associated with the collector name given
 func findIds(collectors []string) []string {
 	ids := make([]string, 0)
-	// todo: RLock()
+	clientLock.RLock()
+	defer clientLock.RUnlock()
 	for id, client := range clients {
 		for _, collector := range collectors {
 			if client.includes(collector) {
@@ -252,17 +288,28 @@ func findIds(collectors []string) []string {
 
 func sendAll(command string, ids []string) {
 	lumber.Trace("[PULSE :: SERVER] sendAll...")
+	clientLock.RLock()
+	defer clientLock.RUnlock()
 	for _, id := range ids {
 		client, ok := clients[id]
 		if ok {
-			go func() {
+			go func(id string) {
 				_, err := client.conn.Write([]byte(command))
 				if err != nil {
 					lumber.Trace("[PULSE :: SERVER] sendAll: Error - %s", err)
-					delete(clients, id)
-					client.conn.Close()
+					forget(id, client)
 				}
-			}()
+			}(id)
 		}
 	}
 }
+
+// forget drops a client that can't be written to
+func forget(id string, c *client) {
+	clientLock.Lock()
+	if clients[id] == c {
+		delete(clients, id)
+	}
+	clientLock.Unlock()
+	c.conn.Close()
+}
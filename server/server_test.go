@@ -1,12 +1,18 @@
 package server_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/spf13/viper"
+
 	"github.com/nanopack/pulse/plexer"
 	"github.com/nanopack/pulse/relay"
 	"github.com/nanopack/pulse/server"
@@ -15,6 +21,10 @@ import (
 var serverAddr = "127.0.0.1:9897"
 var testRelay *relay.Relay
 
+// the latest message published per stat
+var published = map[string]plexer.Message{}
+var publishedLock sync.Mutex
+
 func stdoutPublisher(messages plexer.MessageSet) error {
 	// immitation batch
 	for _, message := range messages.Messages {
@@ -33,6 +43,16 @@ func stdoutPublisher(messages plexer.MessageSet) error {
 		fmt.Printf("BATCH : %s, %s, %s\n", message.ID, tags, message.Data)
 	}
 
+	publishedLock.Lock()
+	for _, message := range messages.Messages {
+		key := message.ID
+		if message.Field != "" {
+			key += "/" + message.Field
+		}
+		published[key] = message
+	}
+	publishedLock.Unlock()
+
 	// immitation single
 	for _, message := range messages.Messages {
 		message.Tags = append(message.Tags, messages.Tags...)
@@ -43,6 +63,9 @@ func stdoutPublisher(messages plexer.MessageSet) error {
 }
 
 func TestMain(m *testing.M) {
+	// read deadlines are based on the beat interval
+	viper.SetDefault("beat-interval", 30)
+
 	go server.StartPolling(nil, nil, 1*time.Second, nil)
 
 	err := server.Listen(serverAddr, stdoutPublisher)
@@ -104,3 +127,312 @@ func TestCollectors(t *testing.T) {
 
 	testRelay.Close()
 }
+
+func TestFailures(t *testing.T) {
+	failRelay, err := relay.NewRelay(serverAddr, "fail_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer failRelay.Close()
+
+	brokenCollector := relay.NewErrPointCollector(func(ctx context.Context) (float64, error) {
+		return 0, errors.New("sensor unplugged")
+	})
+	if err := failRelay.AddCollector("broken", nil, brokenCollector); err != nil {
+		t.Errorf("Failed to add broken collector - %s\n", err)
+		t.FailNow()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	server.Poll([]string{"broken"})
+	time.Sleep(time.Millisecond * 100)
+
+	failure, ok := server.Failures()["fail_client"]["broken"]
+	if !ok || failure.Count < 1 {
+		t.Errorf("Expected failure to be recorded - %v\n", server.Failures())
+		t.FailNow()
+	}
+	if failure.LastError != "sensor unplugged" {
+		t.Errorf("Unexpected failure reason - '%s'\n", failure.LastError)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	var collected int32
+	counted := relay.NewPointCollector(func() float64 {
+		atomic.AddInt32(&collected, 1)
+		return 1
+	})
+
+	configRelay, err := relay.NewRelay(serverAddr, "config_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	if err := configRelay.AddCollector("counted", nil, counted); err != nil {
+		t.Errorf("Failed to add collector - %s\n", err)
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// disabled collectors are acknowledged and no longer collected
+	if err := server.Configure("config_client", "counted", server.Setting{Enabled: false}); err != nil {
+		t.Errorf("Failed to configure - %s\n", err)
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond * 100)
+	if setting := server.Settings()["config_client"]["counted"]; !setting.Applied {
+		t.Errorf("Expected setting to be applied - %+v\n", setting)
+	}
+	// the server may have polled it before it was disabled
+	atomic.StoreInt32(&collected, 0)
+	server.Poll([]string{"counted"})
+	time.Sleep(time.Millisecond * 100)
+	if n := atomic.LoadInt32(&collected); n != 0 {
+		t.Errorf("Disabled collector was collected %d times\n", n)
+	}
+
+	// an interval only applies to collectors sampling on their own
+	server.Configure("config_client", "counted", server.Setting{Enabled: true, Interval: 5})
+	time.Sleep(time.Millisecond * 100)
+	setting := server.Settings()["config_client"]["counted"]
+	if setting.Applied || setting.Error == "" {
+		t.Errorf("Expected interval to be rejected - %+v\n", setting)
+	}
+	if err := server.Configure("config_client", "counted", server.Setting{Interval: -1}); err != server.InvalidSetting {
+		t.Errorf("Expected negative interval to fail - %v\n", err)
+	}
+
+	// settings made while the relay is away are applied when it's back
+	configRelay.Close()
+	time.Sleep(time.Millisecond * 100)
+	server.Configure("config_client", "counted", server.Setting{Enabled: false})
+	if setting := server.Settings()["config_client"]["counted"]; setting.Applied {
+		t.Errorf("Setting applied without a relay - %+v\n", setting)
+	}
+
+	configRelay, err = relay.NewRelay(serverAddr, "config_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer configRelay.Close()
+	configRelay.AddCollector("counted", nil, counted)
+	time.Sleep(time.Millisecond * 100)
+	if setting := server.Settings()["config_client"]["counted"]; !setting.Applied {
+		t.Errorf("Expected setting to be re-applied - %+v\n", setting)
+	}
+}
+
+func TestConfigureWhileConnecting(t *testing.T) {
+	// configuring and polling mustn't race relays connecting (go test -race)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			r, err := relay.NewRelay(serverAddr, "busy_client")
+			if err != nil {
+				continue
+			}
+			r.AddCollector(fmt.Sprintf("busy%d", i), nil, relay.NewPointCollector(func() float64 { return 1 }))
+			r.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		server.Configure("busy_client", "busy0", server.Setting{Enabled: true})
+		server.PollAll()
+		server.Poll([]string{"busy1"})
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSetTags(t *testing.T) {
+	tagRelay, err := relay.NewRelay(serverAddr, "tag_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer tagRelay.Close()
+
+	db := relay.NewPointCollector(func() float64 { return 1 })
+	if err := tagRelay.AddCollector("db", []string{"role:primary"}, db); err != nil {
+		t.Errorf("Failed to add collector - %s\n", err)
+		t.FailNow()
+	}
+	if err := tagRelay.SetTags("missing", []string{"role:replica"}); err != relay.UnknownCollector {
+		t.Errorf("Expected retagging a missing collector to fail - %v\n", err)
+	}
+	if err := tagRelay.SetTags("db", []string{"role:replica"}); err != nil {
+		t.Errorf("Failed to retag collector - %s\n", err)
+		t.FailNow()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	server.Poll([]string{"db"})
+	time.Sleep(time.Millisecond * 100)
+
+	publishedLock.Lock()
+	tags := published["db"].Tags
+	publishedLock.Unlock()
+	if len(tags) != 1 || tags[0] != "role:replica" {
+		t.Errorf("Expected stat to be retagged - %v\n", tags)
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	typedRelay, err := relay.NewRelay(serverAddr, "typed_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer typedRelay.Close()
+
+	build := relay.NewValueCollector(func(ctx context.Context) (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"version":  "1.2, \"beta\":\nrc",
+			"healthy":  true,
+			"requests": uint64(1<<62 + 1),
+			"latency":  0.000012345678,
+		}, nil
+	})
+	if err := typedRelay.AddCollector("build", nil, build); err != nil {
+		t.Errorf("Failed to add collector - %s\n", err)
+		t.FailNow()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	server.Poll([]string{"build"})
+	time.Sleep(time.Millisecond * 100)
+
+	expected := map[string]interface{}{
+		"version":  "1.2, \"beta\":\nrc",
+		"healthy":  true,
+		"requests": int64(1<<62 + 1),
+		"latency":  0.000012345678,
+	}
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+	for id, value := range expected {
+		if published[id].Value != value {
+			t.Errorf("Expected %s to be %#v, got %#v\n", id, value, published[id].Value)
+		}
+	}
+	if published["requests"].Data != "4611686018427387905" {
+		t.Errorf("Unexpected data for requests - '%s'\n", published["requests"].Data)
+	}
+}
+
+func TestHierarchicalNames(t *testing.T) {
+	if err := server.SetTemplates([]string{"disk.device.field"}); err != server.BadTemplate {
+		t.Errorf("Expected template without a measurement to fail - %v\n", err)
+	}
+	if err := server.SetTemplates([]string{"disk.* measurement.device.field"}); err != server.BadTemplate {
+		t.Errorf("Expected filter of a different length to fail - %v\n", err)
+	}
+	if err := server.SetTemplates([]string{"disk.*.* measurement.device.field"}); err != nil {
+		t.Errorf("Failed to set templates - %s\n", err)
+		t.FailNow()
+	}
+	defer server.SetTemplates(nil)
+
+	nameRelay, err := relay.NewRelay(serverAddr, "name_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer nameRelay.Close()
+
+	io := relay.NewSetCollector(func() map[string]float64 {
+		return map[string]float64{"disk.sda.read": 5, "disk.total": 6, "sda-write": 7}
+	})
+	if err := nameRelay.AddCollector("io", []string{"role:db"}, io); err != nil {
+		t.Errorf("Failed to add collector - %s\n", err)
+		t.FailNow()
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	server.Poll([]string{"io"})
+	time.Sleep(time.Millisecond * 100)
+
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+
+	read := published["disk/read"]
+	if read.Data != "5" {
+		t.Errorf("Expected templated stat to be published - %+v\n", read)
+	}
+	if len(read.Tags) != 2 || read.Tags[0] != "role:db" || read.Tags[1] != "device:sda" {
+		t.Errorf("Expected device tag from the name - %v\n", read.Tags)
+	}
+	if published["disk.total"].Data != "6" {
+		t.Errorf("Expected unmatched stat to keep its name - %+v\n", published["disk.total"])
+	}
+	if published["sda-write"].Data != "7" {
+		t.Errorf("Expected dashed stat to be kept - %+v\n", published["sda-write"])
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	collected := time.Unix(1471453619, 0)
+	tagList := func(collector string) []string {
+		if collector == "cpu" {
+			return []string{"cpu:0"}
+		}
+		return nil
+	}
+
+	metric := server.ParseStats("web1", `cpu-used:0.25,build-version:"1,2",bad,ram-used:nope,nodash:1`, tagList, collected)
+	if len(metric.Tags) != 2 || metric.Tags[1] != "host:web1" {
+		t.Errorf("Unexpected set tags - %v\n", metric.Tags)
+	}
+	if len(metric.Messages) != 2 {
+		t.Fatalf("Expected bad stats to be skipped - %+v\n", metric.Messages)
+	}
+	cpu, build := metric.Messages[0], metric.Messages[1]
+	if cpu.ID != "used" || cpu.Value != 0.25 || len(cpu.Tags) != 1 || cpu.Tags[0] != "cpu:0" || !cpu.Time.Equal(collected) {
+		t.Errorf("Unexpected stat - %+v\n", cpu)
+	}
+	if build.ID != "version" || build.Value != "1,2" {
+		t.Errorf("Unexpected stat - %+v\n", build)
+	}
+
+	// sampled values are fields of their name
+	metric = server.ParseStats("web1", "cpu-cpu#max:0.5,cpu-cpu#mean:0.25", tagList, collected)
+	if len(metric.Messages) != 2 || metric.Messages[0].ID != "cpu" || metric.Messages[0].Field != "max" || metric.Messages[1].Field != "mean" {
+		t.Errorf("Expected fields of one measurement - %+v\n", metric.Messages)
+	}
+}
+
+func TestRuntimePrefix(t *testing.T) {
+	prefixRelay, err := relay.NewRelay(serverAddr, "prefix_client")
+	if err != nil {
+		t.Errorf("Failed to create relay - %s\n", err)
+		t.FailNow()
+	}
+	defer prefixRelay.Close()
+
+	prefixRelay.AddCollector("runtime", nil, relay.NewRuntimeCollector())
+	prefixRelay.AddCollector("app", nil, relay.NewValueCollector(func(ctx context.Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"go_goroutines": 100000.0}, nil
+	}))
+
+	time.Sleep(time.Millisecond * 100)
+	server.Poll([]string{"runtime", "app"})
+	time.Sleep(time.Millisecond * 100)
+
+	publishedLock.Lock()
+	defer publishedLock.Unlock()
+	if published["app_go_goroutines"].Value != 100000.0 {
+		t.Errorf("Expected another collector's go_ value to be renamed - %+v\n", published["app_go_goroutines"])
+	}
+	if value, _ := published["go_goroutines"].Value.(float64); value == 0 || value == 100000 {
+		t.Errorf("Expected go_goroutines to be the relay's own - %+v\n", published["go_goroutines"])
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/pulse/plexer"
+)
+
+var (
+	BadValue = errors.New("Unable to parse value")
+)
+
+// splitStats splits a 'got' response on the commas between stats, leaving
+// those inside quoted string values alone
+func splitStats(got string) []string {
+	stats := []string{}
+	quoted := false
+	start := 0
+	for i := 0; i < len(got); i++ {
+		switch got[i] {
+		case '\\':
+			if quoted {
+				i++ // skip the escaped character
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				stats = append(stats, got[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(stats, got[start:])
+}
+
+// parseValue parses a value sent by a relay into a float64, int64, bool or
+// string, along with its plain text form. Integers end in 'i' and strings are
+// quoted, anything else is a float.
+func parseValue(raw string) (interface{}, string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		str, err := strconv.Unquote(raw)
+		if err != nil {
+			return nil, "", BadValue
+		}
+		return str, str, nil
+	case raw == "true" || raw == "false":
+		return raw == "true", raw, nil
+	case strings.HasSuffix(raw, "i"):
+		num, err := strconv.ParseInt(strings.TrimSuffix(raw, "i"), 10, 64)
+		if err != nil {
+			return nil, "", BadValue
+		}
+		return num, strconv.FormatInt(num, 10), nil
+	}
+	num, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, "", BadValue
+	}
+	return num, raw, nil
+}
+
+// ParseStats turns the stats of a relay's 'got' response (eg.
+// `cpu-used:0.25,disk-disk.sda.read:12i`) into a message set tagged with the
+// relay's id. tagList supplies the tags of each collector. Stats that can't be
+// parsed are skipped.
+func ParseStats(id, got string, tagList func(collector string) []string, collected time.Time) plexer.MessageSet {
+	metric := plexer.MessageSet{
+		Tags:     []string{"metrics", "host:" + id},
+		Messages: make([]plexer.Message, 0),
+	}
+
+	for _, stat := range splitStats(got) {
+		// stat may be "test-test:25.25" (or 25i, true, "a string")
+		splitStat := strings.SplitN(stat, ":", 2)
+		if len(splitStat) != 2 {
+			// i can only handle key value
+			continue
+		}
+		// splitstat would be ["test-test", "25.25"]
+		value, data, err := parseValue(splitStat[1])
+		if err != nil {
+			lumber.Trace("[PULSE :: SERVER] Bad value for %s: %s", splitStat[0], splitStat[1])
+			continue
+		}
+
+		// collector names can't hold a '-', so the rest is the stat's
+		// name (eg. "disk-sda-read" or "disk-disk.sda.read")
+		splitName := strings.SplitN(splitStat[0], "-", 2)
+		if len(splitName) != 2 || splitName[1] == "" {
+			// the name didnt come in as collector-name
+			continue
+		}
+		// a name may end in the field it is of (eg. "cpu#max")
+		name, suffix := splitName[1], ""
+		if i := strings.LastIndex(name, "#"); i >= 0 {
+			name, suffix = name[:i], name[i+1:]
+		}
+		measurement, field, nameTags := mapName(name)
+		if suffix != "" {
+			field = strings.TrimPrefix(field+"_"+suffix, "_")
+		}
+		metric.Messages = append(metric.Messages, plexer.Message{
+			ID:    measurement,
+			Field: field,
+			Tags:  append(append([]string{}, tagList(splitName[0])...), nameTags...),
+			Data:  data,
+			Value: value,
+			Time:  collected,
+		})
+	}
+	return metric
+}
@@ -0,0 +1,573 @@
+// Package spool provides an on-disk queue in front of a batch publisher, so
+// stats survive the publisher's storage being down. Message sets are appended
+// to segment files and handed to the publisher in order, retrying with
+// backoff until it takes them. Message sets the publisher rejects for good
+// (see plexer.Permanent) are moved to a dead letter file instead.
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/pulse/plexer"
+)
+
+var (
+	SpoolFull   = errors.New("The spool is full")
+	SpoolClosed = errors.New("The spool is closed")
+	SpoolLocked = errors.New("The spool is in use by another pulse")
+
+	// DefaultOptions are used for any Options left zero
+	DefaultOptions = Options{
+		SegmentSize: 8 << 20,
+		MaxSize:     1 << 30,
+		MinBackoff:  time.Second,
+		MaxBackoff:  time.Minute,
+	}
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+	lockFile   = "lock"
+
+	// DeadLetterFile, in the spool's dir, keeps the message sets the
+	// publisher rejected, a spooled line each
+	DeadLetterFile = "dead-letter.jsonl"
+)
+
+type (
+	// Options size the spool and pace its retries. Once MaxSize bytes are
+	// spooled, the oldest segment is dropped to make room. Failures are
+	// retried with backoff, unless the error is permanent; those message sets
+	// are dead lettered right away.
+	Options struct {
+		SegmentSize int64
+		MaxSize     int64
+		MinBackoff  time.Duration
+		MaxBackoff  time.Duration
+	}
+
+	// Spool queues message sets on disk for a batch publisher
+	Spool struct {
+		dir     string
+		publish plexer.BatchPublisher
+		opts    Options
+		lock    *os.File // held while open so two pulses can't share the dir
+
+		mu       sync.Mutex
+		segments []*segment // oldest first, the last is appended to
+		writer   *os.File
+		offset   int64 // how far into the oldest segment has been published
+		dropped  int
+		dead     int
+		closed   bool
+
+		ready chan struct{} // signals the sender that there's something new
+		done  chan struct{}
+		sent  chan struct{} // closed once the sender has stopped
+	}
+
+	// segment is one file of the spool
+	segment struct {
+		seq     uint64
+		size    int64
+		pending int // records not yet published
+	}
+
+	// record is a message as it's spooled, keeping its value's type
+	record struct {
+		ID    string    `json:"id"`
+		Tags  []string  `json:"tags,omitempty"`
+		Data  string    `json:"data"`
+		Type  string    `json:"type,omitempty"` // f, i, b or s when the value's known
+		Field string    `json:"field,omitempty"`
+		Time  time.Time `json:"time"`
+	}
+
+	// entry is a spooled message set
+	entry struct {
+		Tags     []string `json:"tags,omitempty"`
+		Messages []record `json:"messages"`
+	}
+)
+
+// New opens (or creates) the spool in dir and starts handing what's spooled,
+// including anything left from before, to publish. The dir is locked until
+// the spool is closed; opening it meanwhile returns SpoolLocked.
+func New(dir string, publish plexer.BatchPublisher, opts Options) (*Spool, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultOptions.SegmentSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultOptions.MaxSize
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultOptions.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// the kernel lets go of the lock if pulse dies, unlike a pid file
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, SpoolLocked
+		}
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:     dir,
+		publish: publish,
+		opts:    opts,
+		lock:    lock,
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		sent:    make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	go s.send()
+	s.signal()
+
+	return s, nil
+}
+
+// load finds the spooled segments and where publishing left off
+func (s *Spool) load() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(file), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{seq: seq})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	// the cursor is "{seq} {offset}" of the next record to publish
+	var seq uint64
+	var offset int64
+	if b, err := ioutil.ReadFile(filepath.Join(s.dir, cursorFile)); err == nil {
+		fmt.Sscanf(string(b), "%d %d", &seq, &offset)
+	}
+	for len(s.segments) > 0 && s.segments[0].seq < seq {
+		// published before the cursor was saved past it
+		os.Remove(s.path(s.segments[0].seq))
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0].seq == seq {
+		s.offset = offset
+	}
+
+	for i, seg := range s.segments {
+		from := int64(0)
+		if i == 0 {
+			from = s.offset
+		}
+		if err := seg.count(s.path(seg.seq), from); err != nil {
+			return err
+		}
+	}
+
+	next := uint64(1)
+	if len(s.segments) > 0 {
+		next = s.segments[len(s.segments)-1].seq + 1
+	}
+	return s.roll(next)
+}
+
+// count sizes the segment and counts its records from the offset on
+func (seg *segment) count(path string, from int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	seg.size = info.Size()
+
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		_, err := reader.ReadBytes('\n')
+		if err != nil {
+			// a partial record from a crash mid-write isn't counted
+			return nil
+		}
+		seg.pending++
+	}
+}
+
+// path returns the file of a segment
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// roll starts appending to a new segment, the caller must hold the lock
+// (or be loading)
+func (s *Spool) roll(seq uint64) error {
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	f, err := os.OpenFile(s.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.writer = f
+	s.segments = append(s.segments, &segment{seq: seq})
+	return nil
+}
+
+// signal wakes the sender without blocking
+func (s *Spool) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Publish spools the message set, it is a plexer.BatchPublisher
+func (s *Spool) Publish(messages plexer.MessageSet) error {
+	line, err := encode(messages)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return SpoolClosed
+	}
+
+	current := s.segments[len(s.segments)-1]
+	if current.size > 0 && current.size+int64(len(line)) > s.opts.SegmentSize {
+		if err := s.roll(current.seq + 1); err != nil {
+			return err
+		}
+		current = s.segments[len(s.segments)-1]
+	}
+
+	// make room by dropping the oldest segments, never the one appended to
+	for s.size()+int64(len(line)) > s.opts.MaxSize {
+		if len(s.segments) == 1 {
+			return SpoolFull
+		}
+		oldest := s.segments[0]
+		lumber.Error("[PULSE :: SPOOL] Spool full, dropping %d message sets", oldest.pending)
+		s.dropped += oldest.pending
+		os.Remove(s.path(oldest.seq))
+		s.segments = s.segments[1:]
+		s.offset = 0
+		s.saveCursor()
+	}
+
+	if _, err := s.writer.Write(line); err != nil {
+		return err
+	}
+	if err := s.writer.Sync(); err != nil {
+		return err
+	}
+	current.size += int64(len(line))
+	current.pending++
+
+	s.signal()
+	return nil
+}
+
+// size returns the bytes spooled, the caller must hold the lock
+func (s *Spool) size() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// Depth returns the number of message sets waiting to be published
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	depth := 0
+	for _, seg := range s.segments {
+		depth += seg.pending
+	}
+	return depth
+}
+
+// Size returns the bytes the spool takes on disk
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size()
+}
+
+// Dropped returns the number of message sets dropped to stay under MaxSize
+func (s *Spool) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// DeadLettered returns the number of message sets the publisher rejected
+func (s *Spool) DeadLettered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dead
+}
+
+// send publishes spooled message sets in order until closed
+func (s *Spool) send() {
+	defer close(s.sent)
+
+	backoff := s.opts.MinBackoff
+	for {
+		line, seq, next, err := s.head()
+		if err != nil {
+			lumber.Error("[PULSE :: SPOOL] Failed to read spool - %s", err)
+		}
+		if line == nil {
+			// wait for something new (or retry a failed read)
+			select {
+			case <-s.ready:
+			case <-time.After(backoff):
+			case <-s.done:
+				return
+			}
+			continue
+		}
+
+		messages, err := decode(line)
+		if err != nil {
+			lumber.Error("[PULSE :: SPOOL] Skipping unreadable message set - %s", err)
+			s.advance(seq, next)
+			continue
+		}
+
+		if err := s.publish(messages); err != nil {
+			if plexer.IsPermanent(err) {
+				// retrying won't help, set it aside and move on
+				lumber.Error("[PULSE :: SPOOL] Publish rejected, dead lettering - %s", err)
+				s.deadLetter(line)
+				backoff = s.opts.MinBackoff
+				s.advance(seq, next)
+				continue
+			}
+
+			lumber.Error("[PULSE :: SPOOL] Failed to publish, retrying in %s - %s", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
+				return
+			}
+			backoff *= 2
+			if backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+			continue
+		}
+
+		backoff = s.opts.MinBackoff
+		s.advance(seq, next)
+	}
+}
+
+// deadLetter keeps a rejected message set aside
+func (s *Spool) deadLetter(line []byte) {
+	s.mu.Lock()
+	s.dead++
+	s.mu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(s.dir, DeadLetterFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		lumber.Error("[PULSE :: SPOOL] Failed to dead letter message set - %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(line); err != nil {
+		lumber.Error("[PULSE :: SPOOL] Failed to dead letter message set - %s", err)
+	}
+}
+
+// head reads the oldest unpublished record, returning its segment and the
+// offset after it. Fully published segments are removed along the way.
+func (s *Spool) head() ([]byte, uint64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.pending > 0 {
+			f, err := os.Open(s.path(seg.seq))
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			defer f.Close()
+			if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+				return nil, 0, 0, err
+			}
+			line, err := bufio.NewReader(f).ReadBytes('\n')
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			return line, seg.seq, s.offset + int64(len(line)), nil
+		}
+		if len(s.segments) == 1 {
+			// caught up with what's being appended
+			return nil, 0, 0, nil
+		}
+		os.Remove(s.path(seg.seq))
+		s.segments = s.segments[1:]
+		s.offset = 0
+		s.saveCursor()
+	}
+	return nil, 0, 0, nil
+}
+
+// advance marks the record before offset in the segment as published
+func (s *Spool) advance(seq uint64, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the segment may have been dropped to make room meanwhile
+	if len(s.segments) == 0 || s.segments[0].seq != seq {
+		return
+	}
+	s.segments[0].pending--
+	s.offset = offset
+	s.saveCursor()
+}
+
+// saveCursor records where publishing is up to, the caller must hold the lock
+func (s *Spool) saveCursor() {
+	if len(s.segments) == 0 {
+		return
+	}
+	tmp := filepath.Join(s.dir, cursorFile+".tmp")
+	cursor := fmt.Sprintf("%d %d", s.segments[0].seq, s.offset)
+	if err := ioutil.WriteFile(tmp, []byte(cursor), 0644); err != nil {
+		lumber.Error("[PULSE :: SPOOL] Failed to save cursor - %s", err)
+		return
+	}
+	os.Rename(tmp, filepath.Join(s.dir, cursorFile))
+}
+
+// Close stops publishing, what's still spooled is published once the spool
+// is opened again
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	<-s.sent
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.lock.Close()
+	return s.writer.Close()
+}
+
+// encode spools a message set as a line of json
+func encode(messages plexer.MessageSet) ([]byte, error) {
+	e := entry{Tags: messages.Tags, Messages: make([]record, 0, len(messages.Messages))}
+	for _, message := range messages.Messages {
+		r := record{
+			ID:    message.ID,
+			Tags:  message.Tags,
+			Data:  message.Data,
+			Field: message.Field,
+			Time:  message.Time,
+		}
+		switch message.Value.(type) {
+		case float64:
+			r.Type = "f"
+		case int64:
+			r.Type = "i"
+		case bool:
+			r.Type = "b"
+		case string:
+			r.Type = "s"
+		}
+		e.Messages = append(e.Messages, r)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// decode reads a spooled message set back, restoring each value's type
+func decode(line []byte) (plexer.MessageSet, error) {
+	var e entry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return plexer.MessageSet{}, err
+	}
+
+	messages := plexer.MessageSet{Tags: e.Tags, Messages: make([]plexer.Message, 0, len(e.Messages))}
+	for _, r := range e.Messages {
+		message := plexer.Message{
+			ID:    r.ID,
+			Tags:  r.Tags,
+			Data:  r.Data,
+			Field: r.Field,
+			Time:  r.Time,
+		}
+		switch r.Type {
+		case "f":
+			message.Value, _ = strconv.ParseFloat(r.Data, 64)
+		case "i":
+			message.Value, _ = strconv.ParseInt(r.Data, 10, 64)
+		case "b":
+			message.Value = r.Data == "true"
+		case "s":
+			message.Value = r.Data
+		}
+		messages.Messages = append(messages.Messages, message)
+	}
+	return messages, nil
+}
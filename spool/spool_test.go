@@ -0,0 +1,213 @@
+package spool_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/spool"
+)
+
+// store is a batch publisher that can be taken down
+type store struct {
+	sync.Mutex
+	down bool
+	got  []plexer.MessageSet
+}
+
+func (s *store) publish(messages plexer.MessageSet) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.down {
+		return errors.New("influx unreachable")
+	}
+	s.got = append(s.got, messages)
+	return nil
+}
+
+func (s *store) setDown(down bool) {
+	s.Lock()
+	s.down = down
+	s.Unlock()
+}
+
+func (s *store) ids() []string {
+	s.Lock()
+	defer s.Unlock()
+	ids := []string{}
+	for _, messages := range s.got {
+		for _, message := range messages.Messages {
+			ids = append(ids, message.ID)
+		}
+	}
+	return ids
+}
+
+var fast = spool.Options{MinBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 20}
+
+func set(id string) plexer.MessageSet {
+	return plexer.MessageSet{Tags: []string{"host:test"}, Messages: []plexer.Message{{ID: id, Data: "1", Value: 1.0}}}
+}
+
+// wait until the spool has published everything
+func drained(t *testing.T, sp *spool.Spool) {
+	for i := 0; i < 100 && sp.Depth() > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if depth := sp.Depth(); depth != 0 {
+		t.Fatalf("Spool didn't drain, %d left", depth)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	db := &store{down: true}
+	sp, err := spool.New(dir, db.publish, fast)
+	if err != nil {
+		t.Fatalf("Failed to open spool - %s", err)
+	}
+	defer sp.Close()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := sp.Publish(set(id)); err != nil {
+			t.Errorf("Failed to spool - %s", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	if depth := sp.Depth(); depth != 3 {
+		t.Errorf("Expected 3 spooled sets, got %d", depth)
+	}
+
+	db.setDown(false)
+	drained(t, sp)
+	if ids := db.ids(); len(ids) != 3 || ids[0] != "a" || ids[1] != "b" || ids[2] != "c" {
+		t.Errorf("Sets weren't published in order - %v", ids)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	db := &store{}
+	sp, err := spool.New(dir, db.publish, fast)
+	if err != nil {
+		t.Fatalf("Failed to open spool - %s", err)
+	}
+	sp.Publish(set("a"))
+	drained(t, sp)
+
+	db.setDown(true)
+	typed := plexer.MessageSet{Messages: []plexer.Message{
+		{ID: "requests", Data: "42", Value: int64(42)},
+		{ID: "healthy", Data: "true", Value: true},
+		{ID: "version", Data: "1.2", Value: "1.2"},
+	}}
+	sp.Publish(typed)
+
+	if _, err := spool.New(dir, db.publish, fast); err != spool.SpoolLocked {
+		t.Fatalf("Expected the open spool to be locked, got %v", err)
+	}
+	sp.Close()
+
+	// what wasn't published is replayed, what was isn't
+	db.setDown(false)
+	sp, err = spool.New(dir, db.publish, fast)
+	if err != nil {
+		t.Fatalf("Failed to reopen spool - %s", err)
+	}
+	defer sp.Close()
+	drained(t, sp)
+
+	if ids := db.ids(); len(ids) != 4 || ids[0] != "a" || ids[1] != "requests" {
+		t.Fatalf("Unexpected replay - %v", ids)
+	}
+	db.Lock()
+	replayed := db.got[1].Messages
+	db.Unlock()
+	if replayed[0].Value != int64(42) || replayed[1].Value != true || replayed[2].Value != "1.2" {
+		t.Errorf("Values lost their types - %+v", replayed)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	db := &store{down: true}
+	opts := fast
+	opts.SegmentSize = 200
+	opts.MaxSize = 1000
+	sp, err := spool.New(dir, db.publish, opts)
+	if err != nil {
+		t.Fatalf("Failed to open spool - %s", err)
+	}
+	defer sp.Close()
+
+	for i := 0; i < 50; i++ {
+		if err := sp.Publish(set("stat")); err != nil {
+			t.Fatalf("Failed to spool - %s", err)
+		}
+	}
+	if size := sp.Size(); size > 1000 {
+		t.Errorf("Spool grew past its cap - %d bytes", size)
+	}
+	if sp.Dropped() == 0 || sp.Dropped()+sp.Depth() != 50 {
+		t.Errorf("Expected the oldest sets to be dropped - %d dropped, %d spooled", sp.Dropped(), sp.Depth())
+	}
+
+	db.setDown(false)
+	drained(t, sp)
+	if published := len(db.ids()); published != 50-sp.Dropped() {
+		t.Errorf("Expected %d sets published, got %d", 50-sp.Dropped(), published)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	tries := 0
+	db := &store{}
+	picky := func(messages plexer.MessageSet) error {
+		if messages.Messages[0].ID == "bad" {
+			tries++
+			return plexer.Permanent(errors.New("partial write: field type conflict"))
+		}
+		return db.publish(messages)
+	}
+
+	// a rejected set shouldn't hold up the rest, or wait out the backoff
+	opts := fast
+	opts.MinBackoff = time.Hour
+	opts.MaxBackoff = time.Hour
+	sp, err := spool.New(dir, picky, opts)
+	if err != nil {
+		t.Fatalf("Failed to open spool - %s", err)
+	}
+	defer sp.Close()
+
+	for _, id := range []string{"a", "bad", "b"} {
+		sp.Publish(set(id))
+	}
+	drained(t, sp)
+
+	if ids := db.ids(); len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("Expected the rest to be published - %v", ids)
+	}
+	if tries != 1 || sp.DeadLettered() != 1 {
+		t.Errorf("Expected a rejected set to be dead lettered without retrying, tried %d times (%d dead lettered)", tries, sp.DeadLettered())
+	}
+	dead, _ := ioutil.ReadFile(filepath.Join(dir, spool.DeadLetterFile))
+	if !strings.Contains(string(dead), `"id":"bad"`) || strings.Count(string(dead), "\n") != 1 {
+		t.Errorf("Unexpected dead letters - %s", dead)
+	}
+}
@@ -0,0 +1,217 @@
+// Package webhook provides a batch publisher POSTing stats to http endpoints,
+// forwarding them to systems other than influx or mist.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/pulse/plexer"
+)
+
+var (
+	BadWebhook = errors.New("Webhooks need a name and an http url")
+	BadBody    = errors.New("Webhook template didn't make valid json")
+
+	// ReservedNames are pulse's own publishers, a webhook by one of these
+	// names would replace it
+	ReservedNames = []string{"influx", "archive", "stream", "mist"}
+	ReservedName  = fmt.Errorf("Webhooks can't be named %s", strings.Join(ReservedNames, ", "))
+
+	// RetryWait is how long to wait before the first retry, it doubles for
+	// each one after
+	RetryWait = time.Second
+
+	// DefaultTemplate sends the whole payload as json
+	DefaultTemplate = `{{json .}}`
+
+	// DefaultSignatureHeader carries the body's signature when there's a secret
+	DefaultSignatureHeader = "X-Pulse-Signature"
+
+	funcs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"join": strings.Join,
+	}
+)
+
+type (
+	// Config describes a webhook. Template is a text/template rendering the
+	// json body from a Payload. With a Secret, the body's hex encoded
+	// HMAC-SHA256 is sent as "sha256={signature}" in SignatureHeader. Failed
+	// requests (errors, 429s and 5xxs) are retried up to Retries times with
+	// a doubling backoff, each waiting at most Timeout seconds.
+	Config struct {
+		Name            string            `mapstructure:"name" json:"name"`
+		URL             string            `mapstructure:"url" json:"url"`
+		Method          string            `mapstructure:"method" json:"method,omitempty"`
+		Template        string            `mapstructure:"template" json:"template,omitempty"`
+		Headers         map[string]string `mapstructure:"headers" json:"headers,omitempty"`
+		Secret          string            `mapstructure:"secret" json:"secret,omitempty"`
+		SignatureHeader string            `mapstructure:"signature-header" json:"signature-header,omitempty"`
+		Retries         int               `mapstructure:"retries" json:"retries,omitempty"`
+		Timeout         int               `mapstructure:"timeout" json:"timeout,omitempty"`
+	}
+
+	// Payload is what a webhook's template renders
+	Payload struct {
+		Tags  []string `json:"tags"`
+		Stats []Stat   `json:"stats"`
+	}
+
+	// Stat is a stat as it's sent to webhooks, tagged with its set's tags too
+	Stat struct {
+		ID    string      `json:"id"`
+		Field string      `json:"field,omitempty"`
+		Tags  []string    `json:"tags"`
+		Value interface{} `json:"value"`
+		Time  time.Time   `json:"time"`
+	}
+
+	// Webhook sends stats to an endpoint
+	Webhook struct {
+		Config
+		template *template.Template
+		client   *http.Client
+	}
+)
+
+// New creates a webhook, filling in the config's defaults
+func New(config Config) (*Webhook, error) {
+	if config.Name == "" || !(strings.HasPrefix(config.URL, "http://") || strings.HasPrefix(config.URL, "https://")) {
+		return nil, BadWebhook
+	}
+	for _, name := range ReservedNames {
+		if config.Name == name {
+			return nil, ReservedName
+		}
+	}
+	if config.Method == "" {
+		config.Method = "POST"
+	}
+	if config.Template == "" {
+		config.Template = DefaultTemplate
+	}
+	if config.SignatureHeader == "" {
+		config.SignatureHeader = DefaultSignatureHeader
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
+
+	tmpl, err := template.New(config.Name).Funcs(funcs).Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("Bad template for webhook %s - %s", config.Name, err)
+	}
+
+	return &Webhook{
+		Config:   config,
+		template: tmpl,
+		client:   &http.Client{Timeout: time.Duration(config.Timeout) * time.Second},
+	}, nil
+}
+
+// NewPayload makes the template's data from a message set
+func NewPayload(messages plexer.MessageSet) Payload {
+	payload := Payload{Tags: messages.Tags, Stats: make([]Stat, 0, len(messages.Messages))}
+	if payload.Tags == nil {
+		payload.Tags = []string{}
+	}
+	for _, message := range messages.Messages {
+		stat := Stat{
+			ID:    message.ID,
+			Field: message.Field,
+			Tags:  append(append([]string{}, messages.Tags...), message.Tags...),
+			Value: message.Value,
+			Time:  message.Time,
+		}
+		if stat.Value == nil {
+			stat.Value = message.Data
+		}
+		if stat.Time.IsZero() {
+			stat.Time = time.Now()
+		}
+		payload.Stats = append(payload.Stats, stat)
+	}
+	return payload
+}
+
+// Publish sends the message set to the webhook, it is a plexer.BatchPublisher
+func (hook *Webhook) Publish(messages plexer.MessageSet) error {
+	if len(messages.Messages) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	if err := hook.template.Execute(&body, NewPayload(messages)); err != nil {
+		return err
+	}
+	if !json.Valid(body.Bytes()) {
+		return BadBody
+	}
+
+	wait := RetryWait
+	for attempt := 0; ; attempt++ {
+		retry, err := hook.send(body.Bytes())
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= hook.Retries {
+			return err
+		}
+		lumber.Debug("[PULSE :: WEBHOOK] Retrying %s in %s - %s", hook.Name, wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// send makes one request, reporting whether a failure is worth retrying
+func (hook *Webhook) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(hook.Method, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range hook.Headers {
+		req.Header.Set(key, value)
+	}
+	if hook.Secret != "" {
+		req.Header.Set(hook.SignatureHeader, "sha256="+Sign(hook.Secret, body))
+	}
+
+	res, err := hook.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("Webhook %s responded %s", hook.Name, res.Status)
+	}
+	return false, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of a body, for receivers to check
+// against the signature header
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
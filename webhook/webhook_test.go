@@ -0,0 +1,157 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nanopack/pulse/plexer"
+	"github.com/nanopack/pulse/webhook"
+)
+
+var stats = plexer.MessageSet{Tags: []string{"host:web1"}, Messages: []plexer.Message{
+	{ID: "cpu_used", Tags: []string{"cpu:0"}, Data: "0.34", Value: 0.34},
+	{ID: "ram_used", Data: "0.5"},
+}}
+
+func TestMain(m *testing.M) {
+	webhook.RetryWait = time.Millisecond
+	os.Exit(m.Run())
+}
+
+func TestPublish(t *testing.T) {
+	var body []byte
+	var headers http.Header
+	endpoint := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+		headers = req.Header
+	}))
+	defer endpoint.Close()
+
+	if _, err := webhook.New(webhook.Config{Name: "nope", URL: "ftp://example.com"}); err != webhook.BadWebhook {
+		t.Errorf("Expected a bad webhook, got %v", err)
+	}
+	if _, err := webhook.New(webhook.Config{Name: "influx", URL: endpoint.URL}); err != webhook.ReservedName {
+		t.Errorf("Expected a reserved name, got %v", err)
+	}
+
+	hook, err := webhook.New(webhook.Config{
+		Name:    "ops",
+		URL:     endpoint.URL,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Secret:  "shh",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create webhook - %s", err)
+	}
+	if err := hook.Publish(stats); err != nil {
+		t.Fatalf("Failed to publish - %s", err)
+	}
+
+	if headers.Get("Authorization") != "Bearer secret" || headers.Get("Content-Type") != "application/json" {
+		t.Errorf("Headers weren't sent - %v", headers)
+	}
+	if headers.Get("X-Pulse-Signature") != "sha256="+webhook.Sign("shh", body) {
+		t.Errorf("Bad signature - %s", headers.Get("X-Pulse-Signature"))
+	}
+
+	var payload webhook.Payload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("Bad body '%s' - %s", body, err)
+	}
+	if len(payload.Stats) != 2 || payload.Stats[0].ID != "cpu_used" || payload.Stats[0].Value != 0.34 || payload.Stats[1].Value != "0.5" {
+		t.Errorf("Unexpected payload - %+v", payload)
+	}
+	if tags := payload.Stats[0].Tags; len(tags) != 2 || tags[0] != "host:web1" || tags[1] != "cpu:0" {
+		t.Errorf("Unexpected tags - %v", tags)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	var body []byte
+	endpoint := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer endpoint.Close()
+
+	if _, err := webhook.New(webhook.Config{Name: "bad", URL: endpoint.URL, Template: "{{.Nope"}); err == nil {
+		t.Errorf("Expected a bad template to fail")
+	}
+
+	hook, _ := webhook.New(webhook.Config{
+		Name:     "alerts",
+		URL:      endpoint.URL,
+		Template: `{"source": "pulse", "host": {{json (index .Tags 0)}}, "count": {{len .Stats}}}`,
+	})
+	if err := hook.Publish(stats); err != nil {
+		t.Fatalf("Failed to publish - %s", err)
+	}
+	if string(body) != `{"source": "pulse", "host": "host:web1", "count": 2}` {
+		t.Errorf("Unexpected body - %s", body)
+	}
+
+	hook, _ = webhook.New(webhook.Config{Name: "broken", URL: endpoint.URL, Template: `{"host": {{index .Tags 0}}}`})
+	if err := hook.Publish(stats); err != webhook.BadBody {
+		t.Errorf("Expected invalid json not to be sent, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusServiceUnavailable)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			res.WriteHeader(int(atomic.LoadInt32(&status)))
+		}
+	}))
+	defer endpoint.Close()
+
+	hook, _ := webhook.New(webhook.Config{Name: "flaky", URL: endpoint.URL, Retries: 2})
+	if err := hook.Publish(stats); err != nil {
+		t.Errorf("Expected publishing to succeed on the third try - %s", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+
+	// client errors aren't retried
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	if err := hook.Publish(stats); err == nil {
+		t.Errorf("Expected a bad request to fail")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected 1 request, got %d", n)
+	}
+
+	// server errors are only retried so many times
+	atomic.StoreInt32(&calls, -10)
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	if err := hook.Publish(stats); err == nil {
+		t.Errorf("Expected publishing to give up")
+	}
+	if n := atomic.LoadInt32(&calls); n != -7 {
+		t.Errorf("Expected 3 requests, got %d", n+10)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+	}))
+	defer endpoint.Close()
+
+	hook, _ := webhook.New(webhook.Config{Name: "slow", URL: endpoint.URL, Timeout: 1})
+	start := time.Now()
+	if err := hook.Publish(stats); err == nil {
+		t.Errorf("Expected the request to time out")
+	}
+	if took := time.Since(start); took > 1400*time.Millisecond {
+		t.Errorf("Request wasn't cut short - took %s", took)
+	}
+}